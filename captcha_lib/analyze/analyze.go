@@ -0,0 +1,141 @@
+package analyze
+
+import (
+	"captcha/captcha_lib/chess"
+	"captcha/captcha_lib/hashpuzzle"
+	"captcha/captcha_lib/secret"
+	"captcha/captcha_lib/strength"
+	"captcha/captcha_lib/sudoku"
+	"captcha/captcha_lib/zipenc"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+/***
+
+offline attack cost analysis
+
+every puzzle is generated from the password, so an attacker testing a
+guess only has to regenerate the puzzles and solve them with a computer.
+this measures that per guess cost on the current machine
+
+***/
+
+// the unlock settings of a key slot being analyzed
+type Config struct {
+	N          uint16
+	Sudoku     bool
+	Chess      bool
+	HashPuzzle bool
+	// the settings of the chess puzzles, nil for the defaults
+	ChessOptions *chess.ChessOptions
+}
+
+// the average time spent per guess on each step
+type Cost struct {
+	KDF        time.Duration
+	Sudoku     time.Duration
+	Chess      time.Duration
+	HashPuzzle time.Duration
+	// set when the chess cost could not be measured (no engine)
+	ChessSkipped bool
+	// why the chess puzzles could not be made, e.g. their database is not loaded
+	ChessErr error
+}
+
+// the total time an attacker spends testing one password guess
+func (c Cost) PerGuess() time.Duration {
+	return c.KDF + c.Sudoku + c.Chess + c.HashPuzzle
+}
+
+// guesses per second on this machine
+func (c Cost) GuessesPerSecond() float64 {
+	return float64(time.Second) / float64(c.PerGuess())
+}
+
+// a random password guess so nothing can be cached between samples
+func randomGuess() *secret.Secret {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return secret.Hex(b)
+}
+
+// time f averaged over samples runs, each with a fresh guess
+// f returns the key it derived so it is wiped outside the timing
+func measure(samples int, f func(guess *secret.Secret) *secret.Secret) time.Duration {
+	var total time.Duration
+	for i := 0; i < samples; i++ {
+		guess := randomGuess()
+		start := time.Now()
+		key := f(guess)
+		total += time.Since(start)
+		key.Wipe()
+		guess.Wipe()
+	}
+	return total / time.Duration(samples)
+}
+
+// measure the per guess cost of cfg, each step is averaged over samples runs
+// the chess scan needs the stockfish engine and is skipped without it
+func Measure(cfg Config, samples int) Cost {
+	var cost Cost
+	if samples < 1 {
+		samples = 1
+	}
+	salt := make([]byte, 16)
+	cost.KDF = measure(samples, func(guess *secret.Secret) *secret.Secret {
+		return secret.New(zipenc.HashNb(guess.Bytes(), cfg.N, salt))
+	})
+	if cfg.Sudoku {
+		cost.Sudoku = measure(samples, func(guess *secret.Secret) *secret.Secret { return sudoku.SolvePuzzleKey(guess, cfg.N) })
+	}
+	if cfg.Chess {
+		if chess.EngineAvailable() {
+			cost.Chess = measure(samples, func(guess *secret.Secret) *secret.Secret {
+				key, err := chess.SolvePuzzleKey(guess, cfg.ChessOptions)
+				if err != nil {
+					cost.ChessErr = err
+				}
+				return key
+			})
+		} else {
+			cost.ChessSkipped = true
+		}
+	}
+	if cfg.HashPuzzle {
+		cost.HashPuzzle = measure(samples, hashpuzzle.SolveHashKey)
+	}
+	return cost
+}
+
+// write the per guess cost and the brute force time for each password entropy
+func Report(w io.Writer, cfg Config, cost Cost, entropies []float64) {
+	fmt.Fprintf(w, "per guess cost (hashes=%d sudoku=%t chess=%t hashpuzzle=%t):\n", cfg.N, cfg.Sudoku, cfg.Chess, cfg.HashPuzzle)
+	fmt.Fprintf(w, "  key derivation  %v\n", cost.KDF)
+	if cfg.Sudoku {
+		fmt.Fprintf(w, "  sudoku          %v\n", cost.Sudoku)
+	}
+	if cfg.Chess {
+		switch {
+		case cost.ChessSkipped:
+			fmt.Fprintf(w, "  chess           not measured (stockfish not found)\n")
+		case cost.ChessErr != nil:
+			fmt.Fprintf(w, "  chess           not measured (%v)\n", cost.ChessErr)
+		default:
+			fmt.Fprintf(w, "  chess           %v\n", cost.Chess)
+		}
+	}
+	if cfg.HashPuzzle {
+		fmt.Fprintf(w, "  hashpuzzle      %v\n", cost.HashPuzzle)
+	}
+	fmt.Fprintf(w, "  total           %v (%.3g guesses/second on one core)\n", cost.PerGuess(), cost.GuessesPerSecond())
+
+	fmt.Fprintf(w, "average brute force time on one core:\n")
+	for _, bits := range entropies {
+		seconds := math.Pow(2, bits-1) / cost.GuessesPerSecond()
+		fmt.Fprintf(w, "  %3.0f bit password  %s\n", bits, strength.Duration(seconds))
+	}
+}
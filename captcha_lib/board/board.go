@@ -0,0 +1,359 @@
+package board
+
+import (
+	"image/color"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/app"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+/***
+
+a board of squares for puzzles played by moving pieces
+
+the board draws a grid of squares, each with a colour, an optional piece
+image and a mark (e.g. the last move). a piece is moved by clicking its
+square and then the target, or by dragging it, and the puzzle is told with
+OnMove. the board knows nothing of the rules, the puzzle checks the move and
+sets the squares again
+
+the windows are shown by one app for the whole process, as the app can only
+be run once and only on the main goroutine: main runs under board.Main and
+board.Show reuses its window for every puzzle
+
+use case: board.Main(func() { ... }), b := board.New(8, 8), b.OnMove = ..., b.Set(pos, square), board.Show(...)
+
+***/
+
+// a square by row (from the top) and column (from the left) of the board as it stands unflipped
+type Pos struct {
+	Row int
+	Col int
+}
+
+// how a square is drawn
+type Square struct {
+	Color color.Color
+	// nil when the square is empty
+	Piece fyne.Resource
+	// highlighted, for the last move
+	Marked bool
+}
+
+// the smallest side of a square
+const squareSize = 56
+
+// the colour a marked square is covered with
+var markColor = color.NRGBA{R: 255, G: 230, B: 0, A: 90}
+
+// the outline of the square a move starts from
+var selectColor = color.NRGBA{R: 30, G: 144, B: 255, A: 255}
+
+// a board of rows by cols squares
+type Board struct {
+	widget.BaseWidget
+	rows    int
+	cols    int
+	flipped bool
+	squares []*square
+	grid    *fyne.Container
+	// the square clicked first, a move starts from it
+	selected *square
+	// called when a piece is moved from one square to another
+	OnMove func(from Pos, to Pos)
+}
+
+// a new board of empty squares
+func New(rows int, cols int) *Board {
+	b := &Board{rows: rows, cols: cols}
+	b.grid = container.New(&gridLayout{rows: rows, cols: cols})
+	for i := 0; i < rows*cols; i++ {
+		s := &square{board: b, pos: Pos{Row: i / cols, Col: i % cols}}
+		s.background = canvas.NewRectangle(color.White)
+		s.background.SetMinSize(fyne.NewSize(squareSize, squareSize))
+		s.mark = canvas.NewRectangle(color.Transparent)
+		s.piece = canvas.NewImageFromResource(nil)
+		s.piece.FillMode = canvas.ImageFillContain
+		s.ExtendBaseWidget(s)
+		b.squares = append(b.squares, s)
+	}
+	b.layout()
+	b.ExtendBaseWidget(b)
+	return b
+}
+
+// draw the board upside down, e.g. for the side playing from the top
+func (b *Board) Flip(flipped bool) {
+	b.flipped = flipped
+	b.layout()
+}
+
+// set how the square at p is drawn
+func (b *Board) Set(p Pos, sq Square) {
+	s := b.squares[p.Row*b.cols+p.Col]
+	s.background.FillColor = sq.Color
+	s.mark.FillColor = color.Transparent
+	if sq.Marked {
+		s.mark.FillColor = markColor
+	}
+	s.piece.Resource = sq.Piece
+	s.empty = sq.Piece == nil
+	s.Refresh()
+}
+
+// put the squares in the grid in the order they are shown
+func (b *Board) layout() {
+	b.grid.RemoveAll()
+	for i := range b.squares {
+		b.grid.Add(b.squares[b.index(i/b.cols, i%b.cols)])
+	}
+}
+
+// the index of the square shown at row and col of the grid
+func (b *Board) index(row int, col int) int {
+	if b.flipped {
+		row, col = b.rows-1-row, b.cols-1-col
+	}
+	return row*b.cols + col
+}
+
+// a square was clicked, the first click picks a piece and the second moves it
+func (b *Board) tap(s *square) {
+	from := b.selected
+	b.selectSquare(nil)
+	switch {
+	case from == nil && !s.empty:
+		b.selectSquare(s)
+	case from != nil && from != s:
+		b.move(from.pos, s.pos)
+	}
+}
+
+// outline the square a move starts from, nil for none
+func (b *Board) selectSquare(s *square) {
+	if b.selected != nil {
+		b.selected.mark.StrokeWidth = 0
+		b.selected.Refresh()
+	}
+	b.selected = s
+	if s != nil {
+		s.mark.StrokeColor = selectColor
+		s.mark.StrokeWidth = 3
+		s.Refresh()
+	}
+}
+
+// a piece was dragged from s and dropped at, relative to s
+func (b *Board) drop(s *square, at fyne.Position) {
+	size := s.Size()
+	if s.empty || size.Width == 0 || size.Height == 0 {
+		return
+	}
+	dc, dr := int(math.Floor(float64(at.X/size.Width))), int(math.Floor(float64(at.Y/size.Height)))
+	if b.flipped {
+		dc, dr = -dc, -dr
+	}
+	to := Pos{Row: s.pos.Row + dr, Col: s.pos.Col + dc}
+	if to.Row < 0 || to.Row >= b.rows || to.Col < 0 || to.Col >= b.cols || to == s.pos {
+		return
+	}
+	b.selectSquare(nil)
+	b.move(s.pos, to)
+}
+
+// tell the puzzle of a move
+func (b *Board) move(from Pos, to Pos) {
+	if b.OnMove != nil {
+		b.OnMove(from, to)
+	}
+}
+
+func (b *Board) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(b.grid)
+}
+
+// lays out the squares with no gaps, as large as fit and centred
+type gridLayout struct {
+	rows int
+	cols int
+}
+
+func (g *gridLayout) Layout(objects []fyne.CanvasObject, size fyne.Size) {
+	side := min(size.Width/float32(g.cols), size.Height/float32(g.rows))
+	left := (size.Width - side*float32(g.cols)) / 2
+	top := (size.Height - side*float32(g.rows)) / 2
+	for i, o := range objects {
+		o.Move(fyne.NewPos(left+side*float32(i%g.cols), top+side*float32(i/g.cols)))
+		o.Resize(fyne.NewSize(side, side))
+	}
+}
+
+func (g *gridLayout) MinSize([]fyne.CanvasObject) fyne.Size {
+	return fyne.NewSize(squareSize*float32(g.cols), squareSize*float32(g.rows))
+}
+
+// one square of a board
+type square struct {
+	widget.BaseWidget
+	board      *Board
+	pos        Pos
+	background *canvas.Rectangle
+	mark       *canvas.Rectangle
+	piece      *canvas.Image
+	empty      bool
+	// where a drag from this square is, relative to it
+	dragAt   fyne.Position
+	dragging bool
+}
+
+func (s *square) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(container.NewStack(s.background, s.piece, s.mark))
+}
+
+func (s *square) Tapped(*fyne.PointEvent) {
+	s.board.tap(s)
+}
+
+func (s *square) Dragged(e *fyne.DragEvent) {
+	s.dragAt = e.Position
+	s.dragging = true
+}
+
+func (s *square) DragEnd() {
+	if s.dragging {
+		s.dragging = false
+		s.board.drop(s, s.dragAt)
+	}
+}
+
+// reports whether windows can be shown, on linux and the BSDs this needs X11 or Wayland
+// once the shared app was quit no more windows can be shown
+func DisplayAvailable() bool {
+	if stopped() {
+		return false
+	}
+	switch runtime.GOOS {
+	case "windows", "darwin", "android", "ios":
+		return true
+	}
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+// the app every window is shown by, started on the main goroutine by Main when the first window is asked for
+var shared struct {
+	sync.Mutex
+	// asks the main goroutine to start the app, nil when Main isn't running
+	start chan struct{}
+	// given the window once the app runs
+	ready chan fyne.Window
+	// the one window, hidden between puzzles, as closing the last window quits the app
+	window fyne.Window
+	// closed when the app was quit (e.g. on Ctrl-C), it can't show windows again
+	quit chan struct{}
+}
+
+// run main with the main goroutine left free for the windows, which the app has to run on
+// without a display main is simply called, with one the app is started when Show first needs it
+// and quit when main returns
+func Main(main func()) {
+	if !DisplayAvailable() {
+		main()
+		return
+	}
+	shared.start = make(chan struct{}, 1)
+	shared.ready = make(chan fyne.Window, 1)
+	shared.quit = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		main()
+	}()
+	select {
+	case <-done:
+		return
+	case <-shared.start:
+	}
+	a := app.New()
+	a.Lifecycle().SetOnStarted(func() {
+		shared.ready <- a.NewWindow("")
+	})
+	go func() {
+		<-done
+		a.Quit()
+	}()
+	a.Run()
+	close(shared.quit)
+	<-done
+}
+
+// whether the shared app was quit
+func stopped() bool {
+	select {
+	case <-shared.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// the window of the shared app, nil once the app was quit
+func sharedWindow() fyne.Window {
+	if shared.window == nil && !stopped() {
+		shared.start <- struct{}{}
+		select {
+		case shared.window = <-shared.ready:
+		case <-shared.quit:
+		}
+	}
+	if stopped() {
+		return nil
+	}
+	return shared.window
+}
+
+// show the content made by build in a window until close is called or the window is closed
+// under Main every call reuses the window of one app, without it only the first call can show a window
+// it returns at once when the app was quit
+func Show(title string, size fyne.Size, build func(w fyne.Window, close func()) fyne.CanvasObject) {
+	if shared.start == nil {
+		a := app.New()
+		w := a.NewWindow(title)
+		w.SetContent(build(w, w.Close))
+		w.SetOnClosed(a.Quit)
+		w.Resize(size)
+		w.ShowAndRun()
+		return
+	}
+	shared.Lock()
+	defer shared.Unlock()
+	w := sharedWindow()
+	if w == nil {
+		return
+	}
+	closed := make(chan struct{})
+	var once sync.Once
+	hide := func() {
+		once.Do(func() {
+			w.Hide()
+			close(closed)
+		})
+	}
+	w.SetTitle(title)
+	w.SetCloseIntercept(hide)
+	w.SetContent(build(w, hide))
+	w.Resize(size)
+	w.Show()
+	select {
+	case <-closed:
+	case <-shared.quit:
+		return
+	}
+	w.SetContent(widget.NewLabel(""))
+}
@@ -1,12 +1,15 @@
 package chess
 
 import (
+	"captcha/captcha_lib/secret"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"hash"
+	"io"
 	"math"
 	"math/rand"
+	"os/exec"
 	"strings"
 	"time"
 
@@ -16,59 +19,57 @@ import (
 
 // this is the cutoff point for a chess puzzle point
 // it is measured in centipawns or 1/100 of a pawn (so 700 is 7 pawns)
-// this variable can be changed to alter the difficulty of the chess puzzles
+// this is the default, ChessOptions.Cutoff alters the difficulty of the chess puzzles
 const CUTOFF = 700
 
 // this is the run time the engine uses to perform a estimation of the position, it should be low
-// currently it is 10 ms
+// currently it is 10 ms, ChessOptions.EngineTime changes it
 const engRuntime = time.Second / 100
 
 // this is the run time to calculate the solution to the puzzle, this will give the *best* move in the position
+// ChessOptions.SolutionTime changes it
 const solutionTime = time.Second * 10
 
+// the uci engine executable used to find and solve puzzles
+const engineName = "stockfish"
+
 // this is the number of puzzles to have the user solve
-// increasing this will cause the computation to increase greatly
+// increasing this (with ChessOptions.Puzzles) will cause the computation to increase greatly
 const PuzzleKeyLen = 2
 
 // this function handles having the user find the solution to a chess puzzle
-func promptUserInput(game *chess.Game, solution *chess.Move, retrieveKey bool) bool {
-	if retrieveKey {
-		for {
-			fmt.Println(game.Position().Board().Draw())
-			fmt.Println("it is ", game.Position().Turn().Name(), " to move")
-			fmt.Println("Please enter the next best move in the format:")
-			fmt.Println("piece to move location || location moved to")
-			fmt.Println("example: h8g8 moves the piece at h8 to g8")
+// the move is read in UCI, SAN or long algebraic notation (see input.go)
+// false when the user skips the puzzle, the error wraps ErrNotSolved when the input ends
+func promptUserInput(game *chess.Game, solution *chess.Move, retrieveKey bool) (bool, error) {
+	for {
+		fmt.Println(game.Position().Board().Draw())
+		fmt.Println("it is ", game.Position().Turn().Name(), " to move")
+		fmt.Println("Please enter the next best move, for example:")
+		fmt.Println("h8g8 or e7e8q (the squares moved from and to), Nf3, exd5, O-O or e8=Q (SAN), Ng1-f3 (long algebraic)")
+		if retrieveKey {
 			fmt.Println("if you would like to skip this puzzle then type 'skip'")
-			fmt.Print("Please enter move: ")
-			var w1 string
-			fmt.Scanln(&w1)
-			fmt.Println()
-			if strings.ToLower(w1) == "skip" {
-				return false
-			}
-			if strings.ToLower(w1) == solution.String() {
-				return true
-			} else {
-				fmt.Println("\nThat is not the correct solution")
-			}
 		}
-	} else {
-		for {
-			fmt.Println(game.Position().Board().Draw())
-			fmt.Println("it is ", game.Position().Turn().Name(), " to move")
-			fmt.Println("Please enter the next best move in the format:")
-			fmt.Println("piece to move location || location moved to")
-			fmt.Println("example: h8g8 moves the piece at h8 to g8")
-			fmt.Print("Please enter move: ")
-			var w1 string
-			fmt.Scanln(&w1)
-			fmt.Println()
-			if strings.ToLower(w1) == solution.String() {
-				return true
-			} else {
-				fmt.Println("\nThat is not the correct solution")
+		fmt.Print("Please enter move: ")
+		var w1 string
+		if _, err := fmt.Scanln(&w1); err == io.EOF {
+			return false, fmt.Errorf("%w: the input ended", ErrNotSolved)
+		}
+		fmt.Println()
+		if strings.ToLower(w1) == "skip" {
+			if retrieveKey {
+				return false, nil
 			}
+			fmt.Println("\nThis puzzle can't be skipped")
+			continue
+		}
+		move, err := ParseMove(game.Position(), w1)
+		switch {
+		case err != nil:
+			fmt.Printf("\n%v\n", err)
+		case move.String() == solution.String():
+			return true, nil
+		default:
+			fmt.Println("\nThat is a legal move but not the correct solution")
 		}
 	}
 }
@@ -99,39 +100,84 @@ func HashNb(bs []byte, N uint16, salt []byte) []byte {
 	return bsr
 }
 
+// reports whether the chess engine can be found on the PATH
+func EngineAvailable() bool {
+	_, err := exec.LookPath(engineName)
+	return err == nil
+}
+
 // to export a function just capitalize the first letter
-func GetPuzzleKey(pwd string, offsets []int) (string, []int) {
-	bpwd := Hashb([]byte(pwd), nil)
-	return getChessPuzzles(bpwd, engRuntime, offsets)
+// opts are the settings the puzzles are made with, nil for the defaults
+// puzzles from a database (opts.Source) are drawn from it instead of random games
+// skips are the puzzles skipped when the key was made (see skips.go), nil to make a new key
+// the skips of the key are returned to be stored with it, skips itself is not changed
+func GetPuzzleKey(pwd *secret.Secret, opts *ChessOptions, skips []int) (*secret.Secret, []int, error) {
+	if err := opts.Check(); err != nil {
+		return nil, nil, err
+	}
+	o := opts.withDefaults()
+	bpwd := Hashb(pwd.Bytes(), nil)
+	defer secret.Wipe(bpwd)
+	if o.Source.DB == "" {
+		return getChessPuzzles(bpwd, o, skips, false)
+	}
+	return getDBPuzzles(bpwd, o, skips, false)
 }
 
-// function that takes in the byte string password, a timescale for estimations, and a skipped array (for recovering the key from the byte string)
-func getChessPuzzles(pwd []byte, timeScale time.Duration, skip []int) (string, []int) {
+// compute the puzzle key by accepting the engine's solutions without asking the user
+// used when the key is wrapped for someone else who solves the puzzles later
+func SolvePuzzleKey(pwd *secret.Secret, opts *ChessOptions) (*secret.Secret, error) {
+	if err := opts.Check(); err != nil {
+		return nil, err
+	}
+	o := opts.withDefaults()
+	bpwd := Hashb(pwd.Bytes(), nil)
+	defer secret.Wipe(bpwd)
+	if o.Source.DB == "" {
+		key, _, err := getChessPuzzles(bpwd, o, nil, true)
+		return key, err
+	}
+	key, _, err := getDBPuzzles(bpwd, o, nil, true)
+	return key, err
+}
+
+// function that takes in the byte string password, the settings of the puzzles (with the defaults filled in,
+// opts.Source.Line above 1 asks for a forcing line), the skips recorded when the key was made (nil for a new key)
+// and whether to accept the engine's solutions without prompting the user
+// the scan is bounded and reported by Scan (see scan.go), running out of it fails with ErrScanBudget
+func getChessPuzzles(pwd []byte, opts ChessOptions, recorded []int, auto bool) (*secret.Secret, []int, error) {
+	skipped, err := newSkips(opts, recorded)
+	if err != nil {
+		return nil, nil, err
+	}
 	// set up engine to use stockfish exe
 	salt := make([]byte, 16)
 	key := HashNb(pwd, 12, salt)
-	eng, err := uci.New("stockfish")
+	defer secret.Wipe(key)
+	eng, ctx, stop, err := Scan.start()
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
+	defer stop()
 	defer eng.Close()
-	// initialize uci with new game
-	if err := eng.Run(uci.CmdUCI, uci.CmdIsReady, uci.CmdUCINewGame); err != nil {
-		panic(err)
-	}
 
 	// create a seeded pseudorandom function to be used to generate chess moves
 	Srand := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(key))))
 
-	var result string
-	// maintain state of the number of skipped puzzles for each index
-	skipped := make([]int, PuzzleKeyLen)
+	var result []byte
 	i := 0
+	progress := ScanProgress{Wanted: opts.Puzzles}
+	defer func() { Scan.done(progress) }()
 
-	for i < PuzzleKeyLen {
+	for i < opts.Puzzles {
+		if err := Scan.nextGame(progress); err != nil {
+			secret.Wipe(result)
+			return nil, nil, err
+		}
 		game := chess.NewGame()
+		progress.Games++
 		// randomly perform moves until the game is decided or the puzzle key is finished
-		for game.Outcome() == chess.NoOutcome {
+		for game.Outcome() == chess.NoOutcome && i < opts.Puzzles {
 			// select a random move
 			moves := game.ValidMoves()
 			move := moves[Srand.Intn(len(moves))]
@@ -139,40 +185,75 @@ func getChessPuzzles(pwd []byte, timeScale time.Duration, skip []int) (string, [
 
 			// have the engine perform a quick evaluation to see if anything interesting is happening
 			cmdPos := uci.CmdPosition{Position: game.Position()}
-			cmdGo := uci.CmdGo{MoveTime: timeScale}
+			cmdGo := uci.CmdGo{MoveTime: opts.EngineTime}
 			if err := eng.Run(cmdPos, cmdGo); err != nil {
-				panic(err)
+				secret.Wipe(result)
+				return nil, nil, fmt.Errorf("chess engine: %w", err)
 			}
 			stat := eng.SearchResults()
+			progress.Positions++
+			if err := Scan.step(ctx, progress); err != nil {
+				secret.Wipe(result)
+				return nil, nil, err
+			}
 
 			// compare the current state with the cutoff point for a "puzzle point"
-			if math.Abs(float64(stat.Info.Score.CP)) > CUTOFF && i < PuzzleKeyLen {
-				if skip != nil && skip[i] > 0 {
-					skip[i]--
-					continue
-				}
-
+			if math.Abs(float64(stat.Info.Score.CP)) > float64(opts.Cutoff) && i < opts.Puzzles {
 				// have the engine evaluate the best move in the position
 				cmdPos := uci.CmdPosition{Position: game.Position()}
-				cmdGo := uci.CmdGo{MoveTime: solutionTime}
+				cmdGo := uci.CmdGo{MoveTime: opts.SolutionTime}
 				if err := eng.Run(cmdPos, cmdGo); err != nil {
-					panic(err)
+					secret.Wipe(result)
+					return nil, nil, fmt.Errorf("chess engine: %w", err)
 				}
+				// keys made before VersionSolutionSearch took the move of the quick evaluation
 				solution_move := stat.BestMove
+				if opts.Version >= VersionSolutionSearch {
+					solution_move = eng.SearchResults().BestMove
+				}
 
 				// this next line is for testing purposes as it will display the solution
 				// fmt.Println("Best move: ", solution_move)
 
-				// prompt the user to find the best move
-				guess := promptUserInput(game, solution_move, skip == nil)
+				line := []*chess.Move{solution_move}
+				if opts.Source.Line > 1 {
+					line, err = forcingLine(ctx, eng, game, solution_move, opts)
+					if err != nil {
+						secret.Wipe(result)
+						return nil, nil, err
+					}
+					if line == nil {
+						// not a puzzle after all, it isn't counted as skipped either
+						continue
+					}
+				}
+				if skipped.pass(i) {
+					continue
+				}
+
+				// prompt the user to find the best move, or the line on a copy of the game
+				guess := auto
+				if !auto {
+					// a scan stopped while the line was worked out doesn't ask for it
+					if err := stopped(ctx); err != nil {
+						secret.Wipe(result)
+						return nil, nil, err
+					}
+					guess, err = promptLine(game.Clone(), line, skipped.allowed(i))
+					if err != nil {
+						secret.Wipe(result)
+						return nil, nil, err
+					}
+				}
 				if guess {
-					result += solution_move.String()
+					result = append(result, lineKey(line)...)
 					i++
+					progress.Found = i
 				} else {
-					skipped[i]++
+					skipped.skip(i)
 				}
 			}
 		}
 	}
-	return result, skipped
+	return secret.New(result), skipped.recorded(), nil
 }
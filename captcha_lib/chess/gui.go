@@ -0,0 +1,134 @@
+package chess
+
+import (
+	"captcha/captcha_lib/board"
+	"captcha/captcha_lib/render"
+	"fmt"
+	"image/color"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/notnil/chess"
+)
+
+/***
+
+the chess puzzle on a board in a window
+
+when a display is available the solver plays the puzzle on a board (see
+captcha_lib/board) instead of the terminal. the board is seen from the side
+to move, the replies of a forcing line are played on it and the last move is
+marked. the moves are checked like typed ones, so an illegal move and a
+legal move that isn't the solution are told apart
+
+***/
+
+// the colours of the squares
+var (
+	lightSquare = color.NRGBA{R: 240, G: 217, B: 181, A: 255}
+	darkSquare  = color.NRGBA{R: 181, G: 136, B: 99, A: 255}
+)
+
+// the pieces promoted to, by the name shown
+var promotions = map[string]string{"queen": "q", "rook": "r", "bishop": "b", "knight": "n"}
+
+// the position of a square on the board, rank 8 at the top
+func boardPos(sq chess.Square) board.Pos {
+	return board.Pos{Row: 7 - int(sq.Rank()), Col: int(sq.File())}
+}
+
+// the square at a position of the board
+func boardSquare(p board.Pos) chess.Square {
+	return chess.NewSquare(chess.File(p.Col), chess.Rank(7-p.Row))
+}
+
+// the image of a piece for the board, nil for no piece
+func pieceResource(piece chess.Piece) fyne.Resource {
+	if piece == chess.NoPiece {
+		return nil
+	}
+	return fyne.NewStaticResource(fmt.Sprintf("%s-%s.svg", piece.Color(), piece.Type()), render.PieceSVG(piece))
+}
+
+// draw the position of game on b, marking the squares of the last move
+func drawBoard(b *board.Board, game *chess.Game, last *chess.Move) {
+	pos := game.Position()
+	for sq := chess.A1; sq <= chess.H8; sq++ {
+		s := board.Square{Color: lightSquare, Piece: pieceResource(pos.Board().Piece(sq))}
+		if (int(sq.File())+int(sq.Rank()))%2 == 0 {
+			s.Color = darkSquare
+		}
+		s.Marked = last != nil && (sq == last.S1() || sq == last.S2())
+		b.Set(boardPos(sq), s)
+	}
+}
+
+// have the user play the solver's moves of line on a board in a window, like promptLine
+// solved is false when the window is closed, skipped when the user skips the puzzle
+func promptLineGUI(game *chess.Game, line []*chess.Move, allowSkip bool) (solved bool, skipped bool) {
+	board.Show("CHESS PUZZLE", fyne.NewSize(520, 620), func(w fyne.Window, close func()) fyne.CanvasObject {
+		b := board.New(8, 8)
+		b.Flip(game.Position().Turn() == chess.Black)
+		turn := widget.NewLabel(fmt.Sprintf("%s to move, play the best move", game.Position().Turn().Name()))
+		message := widget.NewLabel("")
+		promotion := widget.NewSelect([]string{"queen", "rook", "bishop", "knight"}, nil)
+		promotion.SetSelected("queen")
+		skip := widget.NewButton("Skip", func() {
+			skipped = true
+			close()
+		})
+		if !allowSkip {
+			skip.Hide()
+		}
+
+		next := 0
+		var last *chess.Move
+		drawBoard(b, game, last)
+		b.OnMove = func(from board.Pos, to board.Pos) {
+			if next >= len(line) {
+				return
+			}
+			s1, s2 := boardSquare(from), boardSquare(to)
+			uci := s1.String() + s2.String()
+			if game.Position().Board().Piece(s1).Type() == chess.Pawn && (s2.Rank() == chess.Rank8 || s2.Rank() == chess.Rank1) {
+				uci += promotions[promotion.Selected]
+			}
+			move, err := ParseMove(game.Position(), uci)
+			switch {
+			case err != nil:
+				message.SetText(err.Error())
+				return
+			case move.String() != line[next].String():
+				message.SetText("That is a legal move but not the correct solution")
+				return
+			}
+			if err := game.Move(move); err != nil {
+				panic(err)
+			}
+			last = move
+			message.SetText("")
+			if next+1 < len(line) {
+				reply := line[next+1]
+				message.SetText(fmt.Sprintf("%s replies %s", game.Position().Turn().Name(), chess.AlgebraicNotation{}.Encode(game.Position(), reply)))
+				if err := game.Move(reply); err != nil {
+					panic(err)
+				}
+				last = reply
+			}
+			next += 2
+			drawBoard(b, game, last)
+			if next >= len(line) {
+				solved = true
+				d := dialog.NewInformation("Success", "Chess puzzle solved!", w)
+				d.SetOnClosed(close)
+				d.Show()
+			}
+		}
+
+		controls := container.NewHBox(widget.NewLabel("Promote to"), promotion, skip)
+		return container.NewBorder(turn, container.NewVBox(message, controls), nil, nil, b)
+	})
+	return solved, skipped
+}
@@ -0,0 +1,78 @@
+package chess
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+/***
+
+reading the solver's moves
+
+a move is accepted in UCI (e2e4, e7e8q), in standard algebraic notation
+(Nf3, exd5, O-O, e8=Q+) or in long algebraic notation (Ng1-f3, e7xd8=Q).
+coordinates are read in any case, piece letters other than b (a file as
+well) in either case and castling with O or 0. a move that can't be
+read, one that isn't legal in the position and a legal move that isn't the
+solution are told apart so the solver knows what went wrong
+
+whatever the notation the move is compared, and goes into the key, as its UCI string
+
+***/
+
+// the input is not a move in any of the notations read
+var ErrNotAMove = errors.New("not a move")
+
+// the input is a move but not a legal one in the position
+var ErrIllegalMove = errors.New("not a legal move")
+
+// a move by its squares: UCI or long algebraic with an optional piece letter
+var coordinateMove = regexp.MustCompile(`^[KQRBNP]?([a-h][1-8])[-x]?([a-h][1-8])=?([qrbn])?$`)
+
+// a move in standard algebraic notation, without check or annotation marks
+var sanMove = regexp.MustCompile(`^([KQRBN]?[a-h]?[1-8]?x?[a-h][1-8](=?[QRBN])?|O-O(-O)?)$`)
+
+// read the move s in the position pos, the error wraps ErrNotAMove or ErrIllegalMove
+func ParseMove(pos *chess.Position, s string) (*chess.Move, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "+#!?")
+	if s == "" {
+		return nil, fmt.Errorf("no move given: %w", ErrNotAMove)
+	}
+	castle := strings.ToUpper(strings.ReplaceAll(s, "0", "O"))
+	if castle == "O-O" || castle == "O-O-O" {
+		s = castle
+	}
+
+	// the squares are read in any case, a piece letter in front is kept
+	for _, coords := range []string{strings.ToLower(s), s[:1] + strings.ToLower(s[1:])} {
+		m := coordinateMove.FindStringSubmatch(coords)
+		if m == nil {
+			continue
+		}
+		uci := m[1] + m[2] + m[3]
+		for _, move := range pos.ValidMoves() {
+			piece := pos.Board().Piece(move.S1()).Type().String()
+			if move.String() == uci && (coords[0] >= 'a' || strings.ToLower(coords[:1]) == piece) {
+				return move, nil
+			}
+		}
+		return nil, fmt.Errorf("%s is %w in this position", s, ErrIllegalMove)
+	}
+
+	// a piece letter in lower case is read too, but for b which is also a file
+	if strings.ContainsRune("kqrn", rune(s[0])) {
+		s = strings.ToUpper(s[:1]) + s[1:]
+	}
+	if sanMove.MatchString(s) {
+		move, err := chess.AlgebraicNotation{}.Decode(pos, s)
+		if err != nil {
+			return nil, fmt.Errorf("%s is %w in this position", s, ErrIllegalMove)
+		}
+		return move, nil
+	}
+	return nil, fmt.Errorf("%s is %w in UCI (e2e4), SAN (Nf3, O-O) or long algebraic notation (Ng1-f3)", s, ErrNotAMove)
+}
@@ -0,0 +1,196 @@
+package chess
+
+import (
+	"captcha/captcha_lib/board"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/notnil/chess"
+	"github.com/notnil/chess/uci"
+)
+
+/***
+
+forcing lines
+
+a puzzle can ask for a whole forcing line instead of a single best move. the
+solver plays every move of their side, the opponent's replies are played for
+them, and the key takes the hash of the whole line (one move alone is kept as
+its UCI string so keys made before lines existed stay the same)
+
+from a database the line is the known solution. from the engine the line
+goes on while the solver's move is the only one that keeps a winning score
+(above the cutoff, CUTOFF by default, or a mate), checked by searching every other move, and stops
+when that no longer holds or the game ends. from VersionCheckedLines on the
+first move is held to the same test and a position failing it is no puzzle
+
+***/
+
+// the run time the engine uses to find the opponent's reply in a forcing line
+const replyTime = time.Second
+
+// the key part of a solved line, the move alone for a single move and the
+// SHA256 of the line (solver's moves and replies) for longer ones
+func lineKey(line []*chess.Move) []byte {
+	if len(line) == 1 {
+		return []byte(line[0].String())
+	}
+	moves := make([]string, len(line))
+	for i, m := range line {
+		moves[i] = m.String()
+	}
+	sum := sha256.Sum256([]byte(strings.Join(moves, " ")))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// the number of moves of a line where the solver plays moves of their own
+func lineLength(moves int) int {
+	if moves < 1 {
+		moves = 1
+	}
+	return 2*moves - 1
+}
+
+// the user gave up on a chess puzzle: the input ended or the puzzle window was closed
+var ErrNotSolved = errors.New("chess puzzle not solved")
+
+// have the user play the solver's moves of line from the position of game
+// the replies between them are played automatically, game is moved along
+// false when the user skips the puzzle, the error wraps ErrNotSolved when they give up
+// the puzzle is played on a board in a window when a display is available
+func promptLine(game *chess.Game, line []*chess.Move, allowSkip bool) (bool, error) {
+	if board.DisplayAvailable() {
+		solved, skipped := promptLineGUI(game, line, allowSkip)
+		if !solved && !skipped {
+			return false, fmt.Errorf("%w: the puzzle window was closed", ErrNotSolved)
+		}
+		return solved, nil
+	}
+	for i, move := range line {
+		if i%2 == 1 {
+			san := chess.AlgebraicNotation{}.Encode(game.Position(), move)
+			fmt.Printf("%s replies %s (%s)\n\n", game.Position().Turn().Name(), san, move)
+		} else if solved, err := promptUserInput(game, move, allowSkip); !solved {
+			return false, err
+		}
+		if err := game.Move(move); err != nil {
+			panic(err)
+		}
+	}
+	return true, nil
+}
+
+// decode the UCI moves of a line from the position of game, without moving game
+func decodeLine(game *chess.Game, moves []string) ([]*chess.Move, error) {
+	g := game.Clone()
+	var line []*chess.Move
+	for _, s := range moves {
+		move, err := chess.UCINotation{}.Decode(g.Position(), s)
+		if err != nil {
+			return nil, fmt.Errorf("move %s: %v", s, err)
+		}
+		if err := g.Move(move); err != nil {
+			return nil, fmt.Errorf("move %s: %v", s, err)
+		}
+		line = append(line, move)
+	}
+	return line, nil
+}
+
+// whether the score of the side to move is winning, by more than cutoff centipawns or a mate
+func winning(score uci.Score, cutoff int) bool {
+	return score.Mate > 0 || (score.Mate == 0 && score.CP > cutoff)
+}
+
+// search pos with the engine for timeScale, only among moves when given
+// nothing is searched once ctx is done
+func search(ctx context.Context, eng *uci.Engine, pos *chess.Position, timeScale time.Duration, moves []*chess.Move) (uci.SearchResults, error) {
+	if err := stopped(ctx); err != nil {
+		return uci.SearchResults{}, err
+	}
+	cmdPos := uci.CmdPosition{Position: pos}
+	cmdGo := uci.CmdGo{MoveTime: timeScale, SearchMoves: moves}
+	if err := eng.Run(cmdPos, cmdGo); err != nil {
+		return uci.SearchResults{}, fmt.Errorf("chess engine: %w", err)
+	}
+	return eng.SearchResults(), nil
+}
+
+// whether best is the only move in pos that keeps the side to move winning
+func onlyWinning(ctx context.Context, eng *uci.Engine, pos *chess.Position, best *chess.Move, opts ChessOptions) (bool, error) {
+	var others []*chess.Move
+	for _, m := range pos.ValidMoves() {
+		if m.String() != best.String() {
+			others = append(others, m)
+		}
+	}
+	if len(others) == 0 {
+		return true, nil
+	}
+	res, err := search(ctx, eng, pos, opts.SolutionTime, others)
+	if err != nil {
+		return false, err
+	}
+	return !winning(res.Info.Score, opts.Cutoff), nil
+}
+
+// extend the puzzle starting with first in the position of game into a forcing
+// line of at most opts.Source.Line moves of the solver, game is not moved
+// nil when first is not the only move keeping the solver winning (from VersionCheckedLines on)
+// the error is the engine's, or why the scan stopped once ctx is done
+func forcingLine(ctx context.Context, eng *uci.Engine, game *chess.Game, first *chess.Move, opts ChessOptions) ([]*chess.Move, error) {
+	if opts.Version >= VersionCheckedLines {
+		pos := game.Position()
+		res, err := search(ctx, eng, pos, opts.SolutionTime, []*chess.Move{first})
+		if err != nil {
+			return nil, err
+		}
+		if !winning(res.Info.Score, opts.Cutoff) {
+			return nil, nil
+		}
+		if only, err := onlyWinning(ctx, eng, pos, first, opts); !only {
+			return nil, err
+		}
+	}
+	g := game.Clone()
+	line := []*chess.Move{first}
+	if err := g.Move(first); err != nil {
+		panic(err)
+	}
+	for len(line) < lineLength(opts.Source.Line) && g.Outcome() == chess.NoOutcome {
+		res, err := search(ctx, eng, g.Position(), replyTime, nil)
+		if err != nil {
+			return nil, err
+		}
+		reply := res.BestMove
+		if err := g.Move(reply); err != nil {
+			panic(err)
+		}
+		if g.Outcome() != chess.NoOutcome {
+			// the line ends with the solver's move
+			break
+		}
+		best, err := search(ctx, eng, g.Position(), opts.SolutionTime, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !winning(best.Info.Score, opts.Cutoff) {
+			break
+		}
+		if only, err := onlyWinning(ctx, eng, g.Position(), best.BestMove, opts); err != nil {
+			return nil, err
+		} else if !only {
+			break
+		}
+		line = append(line, reply, best.BestMove)
+		if err := g.Move(best.BestMove); err != nil {
+			panic(err)
+		}
+	}
+	return line, nil
+}
@@ -0,0 +1,111 @@
+package chess
+
+import (
+	"fmt"
+	"time"
+)
+
+/***
+
+the settings of the chess puzzles of a key
+
+how hard the puzzles are and how many are asked for decide the key, so they
+are recorded with the key slot and the slot is unlocked with the settings it
+was created with. a zero field takes the default (the constants in chess.go),
+so a slot without settings is unlocked as before
+
+fixes to the puzzle search change the keys it makes, so they only apply from
+the Version recorded with a key on. new keys are made with CurrentVersion
+and a key is always made again with the search it was made with
+
+use case: key, skipped, err := chess.GetPuzzleKey(pwd, &chess.ChessOptions{Cutoff: 500, Puzzles: 3}, nil)
+
+***/
+
+// the defaults of ChessOptions.EngineTime and SolutionTime
+const (
+	DefaultEngineTime   = engRuntime
+	DefaultSolutionTime = solutionTime
+)
+
+// the most puzzles a key can ask for
+const MaxPuzzles = 10
+
+// the revisions of the puzzle search (ChessOptions.Version)
+const (
+	// keys made before the revision was recorded
+	VersionOriginal = 0
+	// the first move of a forcing line has to be the only winning move too
+	VersionCheckedLines = 1
+	// the solution is the best move of the SolutionTime search, not of the quick evaluation
+	VersionSolutionSearch = 2
+	// the revision new keys are made with
+	CurrentVersion = VersionSolutionSearch
+)
+
+// the settings of the chess puzzles, nil or a zero field for the default
+type ChessOptions struct {
+	// the swing in centipawns that makes a position a puzzle (CUTOFF)
+	Cutoff int `json:"Cutoff,omitempty"`
+	// how long the engine looks at each position of the random games (engRuntime)
+	EngineTime time.Duration `json:"EngineTime,omitempty"`
+	// how long the engine looks for the solution of a puzzle (solutionTime)
+	SolutionTime time.Duration `json:"SolutionTime,omitempty"`
+	// the number of puzzles to solve (PuzzleKeyLen)
+	Puzzles int `json:"Puzzles,omitempty"`
+	// where the puzzles are drawn from, nil for random games of single moves
+	Source *PuzzleSource `json:"Source,omitempty"`
+	// the puzzles the solver may skip for each puzzle of the key (DefaultMaxSkips)
+	MaxSkips int `json:"MaxSkips,omitempty"`
+	// the revision of the puzzle search the key is made with, CurrentVersion for new keys
+	Version int `json:"Version,omitempty"`
+}
+
+// the options with the defaults filled in, opts may be nil
+func (opts *ChessOptions) withDefaults() ChessOptions {
+	var o ChessOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Cutoff == 0 {
+		o.Cutoff = CUTOFF
+	}
+	if o.EngineTime == 0 {
+		o.EngineTime = engRuntime
+	}
+	if o.SolutionTime == 0 {
+		o.SolutionTime = solutionTime
+	}
+	if o.Puzzles == 0 {
+		o.Puzzles = PuzzleKeyLen
+	}
+	if o.Source == nil {
+		o.Source = &PuzzleSource{}
+	}
+	if o.MaxSkips == 0 {
+		o.MaxSkips = DefaultMaxSkips
+	}
+	return o
+}
+
+// report settings no key can be made with, e.g. read from a damaged header
+func (opts *ChessOptions) Check() error {
+	if opts == nil {
+		return nil
+	}
+	switch {
+	case opts.Cutoff < 0:
+		return fmt.Errorf("chess cutoff %d is negative", opts.Cutoff)
+	case opts.EngineTime < 0 || opts.SolutionTime < 0:
+		return fmt.Errorf("chess engine times %v and %v must not be negative", opts.EngineTime, opts.SolutionTime)
+	case opts.Puzzles < 0 || opts.Puzzles > MaxPuzzles:
+		return fmt.Errorf("%d chess puzzles is not between 1 and %d", opts.Puzzles, MaxPuzzles)
+	case opts.MaxSkips < 0:
+		return fmt.Errorf("chess max skips %d is negative", opts.MaxSkips)
+	case opts.Source != nil && opts.Source.Line < 0:
+		return fmt.Errorf("chess line of %d moves is negative", opts.Source.Line)
+	case opts.Version < 0 || opts.Version > CurrentVersion:
+		return fmt.Errorf("chess puzzle search version %d is unknown, at most %d is supported", opts.Version, CurrentVersion)
+	}
+	return nil
+}
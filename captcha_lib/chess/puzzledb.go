@@ -0,0 +1,342 @@
+package chess
+
+import (
+	"bufio"
+	"bytes"
+	"captcha/captcha_lib/secret"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+/***
+
+chess puzzles from a puzzle database
+
+instead of playing random games until the engine sees a large swing, the
+puzzles can be drawn from a set of curated puzzles. the password hash
+seeds the draw so the same password always draws the same puzzles, and
+the known solution line takes the place of the engine, so no engine is needed
+
+a database is read from the Lichess puzzle CSV (PuzzleId,FEN,Moves,Rating,...
+where the first move is the opponent's and the solution follows it), from
+EPD (one position per line with a single "bm" move) or from PGN (a game per
+puzzle starting at its FEN tag, the moves are the solution). a small set in
+the Lichess format is built in
+
+a slot records the SHA256 of the database it drew from and the rating range,
+a database other than the built in one has to be loaded again to decrypt.
+with Line set the solver plays that many moves of the solution (see lines.go),
+puzzles with a shorter solution are played to their end
+
+***/
+
+//go:embed puzzles.csv
+var embeddedPuzzles []byte
+
+// the name of the built in database
+const EmbeddedDB = "embedded"
+
+// a puzzle of a database
+// FEN is the position the solver sees and Moves the solution line in UCI,
+// the solver's moves alternating with the opponent's replies
+type Puzzle struct {
+	ID     string
+	FEN    string
+	Moves  []string
+	Rating int
+}
+
+// a set of puzzles, Hash identifies it in the slots that draw from it
+type PuzzleDB struct {
+	Name    string
+	Hash    string
+	Puzzles []Puzzle
+}
+
+// the puzzles a key draws from, recorded with the slot so the same puzzles are drawn again
+// an empty DB draws from random games, a rating of 0 leaves that end of the range open
+// Line is the moves the solver plays per puzzle, 0 or 1 asks for the best move only
+type PuzzleSource struct {
+	DB        string `json:"DB,omitempty"`
+	MinRating int    `json:"MinRating,omitempty"`
+	MaxRating int    `json:"MaxRating,omitempty"`
+	Line      int    `json:"Line,omitempty"`
+}
+
+// the databases loaded, by hash
+var databases = map[string]*PuzzleDB{}
+
+// the built in database
+func Embedded() *PuzzleDB {
+	db, err := ParsePuzzleDB(EmbeddedDB, embeddedPuzzles, "csv")
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// read a database from file, the format follows the extension (.csv, .epd or .pgn)
+// "embedded" names the built in database
+// the database is kept so slots drawing from it can be unlocked
+func LoadPuzzleDB(file string) (*PuzzleDB, error) {
+	if file == EmbeddedDB {
+		return Embedded(), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(file)), ".")
+	return ParsePuzzleDB(filepath.Base(file), data, format)
+}
+
+// parse a database in format (csv, epd or pgn) and keep it
+func ParsePuzzleDB(name string, data []byte, format string) (*PuzzleDB, error) {
+	sum := sha256.Sum256(data)
+	db := &PuzzleDB{Name: name, Hash: hex.EncodeToString(sum[:])}
+	if loaded, ok := databases[db.Hash]; ok {
+		return loaded, nil
+	}
+	var err error
+	switch format {
+	case "csv":
+		db.Puzzles, err = parseCSV(data)
+	case "epd":
+		db.Puzzles, err = parseEPD(data)
+	case "pgn":
+		db.Puzzles, err = parsePGN(data)
+	default:
+		return nil, fmt.Errorf("unknown puzzle database format %q (csv, epd or pgn)", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(db.Puzzles) == 0 {
+		return nil, fmt.Errorf("%s holds no puzzles", name)
+	}
+	databases[db.Hash] = db
+	return db, nil
+}
+
+// the loaded database with hash, the built in one is always found
+func FindPuzzleDB(hash string) (*PuzzleDB, error) {
+	if _, ok := databases[hash]; !ok {
+		Embedded()
+	}
+	db, ok := databases[hash]
+	if !ok {
+		return nil, fmt.Errorf("the chess puzzles come from a database that is not loaded (SHA256 %s), give it with -chess-db", hash)
+	}
+	return db, nil
+}
+
+// the source drawing from db within the rating range
+func (db *PuzzleDB) Source(minRating int, maxRating int) PuzzleSource {
+	return PuzzleSource{DB: db.Hash, MinRating: minRating, MaxRating: maxRating}
+}
+
+// the puzzles of db within the rating range of src
+func (db *PuzzleDB) filter(src PuzzleSource) []Puzzle {
+	var puzzles []Puzzle
+	for _, p := range db.Puzzles {
+		if (src.MinRating == 0 || p.Rating >= src.MinRating) && (src.MaxRating == 0 || p.Rating <= src.MaxRating) {
+			puzzles = append(puzzles, p)
+		}
+	}
+	return puzzles
+}
+
+// play the moves of a line from fen, checking every one is legal
+// returns the positions before each move
+func playLine(fen string, moves []string) ([]*chess.Position, error) {
+	start, err := chess.FEN(fen)
+	if err != nil {
+		return nil, err
+	}
+	game := chess.NewGame(start, chess.UseNotation(chess.UCINotation{}))
+	var positions []*chess.Position
+	for _, m := range moves {
+		positions = append(positions, game.Position())
+		if err := game.MoveStr(m); err != nil {
+			return nil, fmt.Errorf("move %s: %v", m, err)
+		}
+	}
+	return positions, nil
+}
+
+// parse the Lichess puzzle CSV, the first move is the opponent's and is played here
+func parseCSV(data []byte) ([]Puzzle, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	var puzzles []Puzzle
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 4 || record[0] == "PuzzleId" {
+			continue
+		}
+		moves := strings.Fields(record[2])
+		if len(moves) < 2 {
+			return nil, fmt.Errorf("line %d: no solution after the opponent's move", line)
+		}
+		positions, err := playLine(record[1], moves)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rating, _ := strconv.Atoi(record[3])
+		puzzles = append(puzzles, Puzzle{ID: record[0], FEN: positions[1].String(), Moves: moves[1:], Rating: rating})
+	}
+	return puzzles, nil
+}
+
+// parse EPD, positions with one best move (bm, in SAN) are kept
+func parseEPD(data []byte) ([]Puzzle, error) {
+	var puzzles []Puzzle
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fen := strings.Join(fields[:4], " ") + " 0 1"
+		ops := map[string]string{}
+		for _, op := range strings.Split(strings.Join(fields[4:], " "), ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(op), " ")
+			ops[name] = strings.Trim(strings.TrimSpace(value), "\"")
+		}
+		bm := strings.Fields(ops["bm"])
+		if len(bm) != 1 {
+			continue
+		}
+		start, err := chess.FEN(fen)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		pos := chess.NewGame(start).Position()
+		move, err := chess.AlgebraicNotation{}.Decode(pos, bm[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		id := ops["id"]
+		if id == "" {
+			id = strconv.Itoa(line)
+		}
+		puzzles = append(puzzles, Puzzle{ID: id, FEN: pos.String(), Moves: []string{move.String()}})
+	}
+	return puzzles, scanner.Err()
+}
+
+// parse PGN, every game is a puzzle starting at its FEN tag
+func parsePGN(data []byte) ([]Puzzle, error) {
+	var puzzles []Puzzle
+	scanner := chess.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		game := scanner.Next()
+		if len(game.Moves()) == 0 {
+			continue
+		}
+		p := Puzzle{ID: strconv.Itoa(n), FEN: game.Positions()[0].String()}
+		for _, m := range game.Moves() {
+			p.Moves = append(p.Moves, m.String())
+		}
+		for _, tag := range game.TagPairs() {
+			switch strings.ToLower(tag.Key) {
+			case "puzzleid":
+				p.ID = tag.Value
+			case "rating", "puzzlerating":
+				p.Rating, _ = strconv.Atoi(tag.Value)
+			}
+		}
+		puzzles = append(puzzles, p)
+	}
+	return puzzles, scanner.Err()
+}
+
+// draw the puzzles for pwd from src and have the user solve them
+// like getChessPuzzles a skipped puzzle is replaced by the next one drawn,
+// recorded replays the skips made when the key was created (nil for a new key)
+// opts has the defaults filled in
+func getDBPuzzles(pwd []byte, opts ChessOptions, recorded []int, auto bool) (*secret.Secret, []int, error) {
+	skipped, err := newSkips(opts, recorded)
+	if err != nil {
+		return nil, nil, err
+	}
+	src := *opts.Source
+	db, err := FindPuzzleDB(src.DB)
+	if err != nil {
+		return nil, nil, err
+	}
+	puzzles := db.filter(src)
+	salt := make([]byte, 16)
+	key := HashNb(pwd, 12, salt)
+	defer secret.Wipe(key)
+	Srand := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(key))))
+	// stopped by Scan.Context and, with Scan.Interrupt, Ctrl-C like the scan of random games
+	ctx, stop := Scan.context()
+	defer stop()
+
+	var result []byte
+	drawn := make(map[int]bool)
+	i := 0
+	for i < opts.Puzzles {
+		if len(drawn) == len(puzzles) {
+			secret.Wipe(result)
+			return nil, nil, fmt.Errorf("%s has %d puzzles rated %d to %d, too few for the puzzles and skips asked for", db.Name, len(puzzles), src.MinRating, src.MaxRating)
+		}
+		if ctx.Err() != nil {
+			secret.Wipe(result)
+			return nil, nil, fmt.Errorf("chess puzzles stopped: %w", ctx.Err())
+		}
+		n := Srand.Intn(len(puzzles))
+		if drawn[n] {
+			continue
+		}
+		drawn[n] = true
+		if skipped.pass(i) {
+			continue
+		}
+
+		p := puzzles[n]
+		start, err := chess.FEN(p.FEN)
+		if err != nil {
+			return nil, nil, fmt.Errorf("puzzle %s: %v", p.ID, err)
+		}
+		game := chess.NewGame(start)
+		line, err := decodeLine(game, p.Moves[:min(len(p.Moves), lineLength(src.Line))])
+		if err != nil {
+			return nil, nil, fmt.Errorf("puzzle %s: %v", p.ID, err)
+		}
+		solved := auto
+		if !auto {
+			solved, err = promptLine(game, line, skipped.allowed(i))
+			if err != nil {
+				secret.Wipe(result)
+				return nil, nil, err
+			}
+		}
+		if solved {
+			result = append(result, lineKey(line)...)
+			i++
+		} else {
+			skipped.skip(i)
+		}
+	}
+	return secret.New(result), skipped.recorded(), nil
+}
@@ -0,0 +1,155 @@
+package chess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/notnil/chess/uci"
+)
+
+/***
+
+limits and reporting of the scan for puzzles
+
+the puzzles of random games are found by playing games and evaluating every
+position until enough large swings turn up. a password can need many games,
+so the scan stops with ErrScanBudget after MaxGames games or MaxPositions
+positions, reports how far it got to Progress and stops when Context is
+cancelled, closing the engine on the way out. with Interrupt set Ctrl-C
+cancels it too: the engine is started ignoring Ctrl-C, so it is closed by
+the scan instead of being killed under it, and a second Ctrl-C (e.g. while
+waiting for a move) quits as usual. puzzles drawn from a database are
+stopped by Context and Interrupt the same way
+
+the limits only decide when to give up, they are not stored with the key. a
+key made within the budget needs about the same scan to be made again, so
+the budget should leave room for a slower machine
+
+***/
+
+// the scan ran out of games or positions before enough puzzles were found
+var ErrScanBudget = errors.New("chess puzzle scan budget exhausted")
+
+// how far a scan has got
+type ScanProgress struct {
+	Games     int
+	Positions int
+	// the puzzles accepted so far out of those asked for
+	Found  int
+	Wanted int
+	// set on the last report, when the scan has stopped
+	Done bool
+}
+
+// the limits and reporting of a scan, 0 leaves a limit open
+type ScanOptions struct {
+	MaxGames     int
+	MaxPositions int
+	// called after every position evaluated and once more when the scan stops, nil for no reporting
+	Progress func(ScanProgress)
+	// stops the scan when done, nil never stops it
+	Context context.Context
+	// stop the scan on Ctrl-C as well
+	Interrupt bool
+}
+
+// the scan settings used to make keys, they can be replaced by callers
+var Scan = ScanOptions{MaxGames: 2000, MaxPositions: 200000}
+
+// start the engine and the context stopping the scan, stop releases the context
+// on an error the engine is closed and Ctrl-C handled as before
+func (s ScanOptions) start() (eng *uci.Engine, ctx context.Context, stop func(), err error) {
+	if s.Interrupt {
+		// Ctrl-C is ignored until the engine has answered, so it is started ignoring it too
+		signal.Ignore(os.Interrupt)
+	}
+	eng, err = uci.New(engineName)
+	if err != nil {
+		if s.Interrupt {
+			signal.Reset(os.Interrupt)
+		}
+		return nil, nil, nil, fmt.Errorf("starting the chess engine: %w", err)
+	}
+	// initialize uci with new game
+	if err := eng.Run(uci.CmdUCI, uci.CmdIsReady, uci.CmdUCINewGame); err != nil {
+		eng.Close()
+		if s.Interrupt {
+			signal.Reset(os.Interrupt)
+		}
+		return nil, nil, nil, fmt.Errorf("starting the chess engine: %w", err)
+	}
+	ctx, stop = s.context()
+	return eng, ctx, stop, nil
+}
+
+// the context stopping the scan, with Interrupt set cancelled by Ctrl-C as well
+// stop releases the context
+func (s ScanOptions) context() (ctx context.Context, stop func()) {
+	ctx = s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, stop = context.WithCancel(ctx)
+	if !s.Interrupt {
+		return ctx, stop
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			fmt.Println("\ninterrupted, stopping the chess puzzle scan (Ctrl-C again to quit now)")
+			stop()
+		case <-ctx.Done():
+		}
+		// a second Ctrl-C quits
+		signal.Stop(interrupt)
+	}()
+	return ctx, stop
+}
+
+// why the scan has to stop before going on, nil when ctx isn't done
+func stopped(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("chess puzzle scan stopped: %w", ctx.Err())
+	}
+	return nil
+}
+
+// report the end of a scan at p
+func (s ScanOptions) done(p ScanProgress) {
+	if s.Progress != nil {
+		p.Done = true
+		s.Progress(p)
+	}
+}
+
+// report the progress p and return why the scan has to stop, nil to go on
+func (s ScanOptions) step(ctx context.Context, p ScanProgress) error {
+	if s.Progress != nil {
+		s.Progress(p)
+	}
+	if err := stopped(ctx); err != nil {
+		return err
+	}
+	if s.MaxPositions > 0 && p.Positions >= s.MaxPositions {
+		return budgetError(p)
+	}
+	return nil
+}
+
+// return why another game can't be started after p, nil when it can
+func (s ScanOptions) nextGame(p ScanProgress) error {
+	if s.MaxGames > 0 && p.Games >= s.MaxGames {
+		return budgetError(p)
+	}
+	return nil
+}
+
+// the budget ran out at p
+func budgetError(p ScanProgress) error {
+	return fmt.Errorf("%w: %d positions of %d games gave %d of %d puzzles", ErrScanBudget, p.Positions, p.Games, p.Found, p.Wanted)
+}
@@ -0,0 +1,71 @@
+package chess
+
+import "fmt"
+
+/***
+
+skipped puzzles
+
+while a key is made the solver can skip a puzzle and the next one drawn
+takes its place, up to MaxSkips times for each puzzle of the key. the skips
+(one count per puzzle) are returned with the key and stored with its slot.
+making the key again replays them: the puzzles skipped are passed over
+without being shown, so the solver is presented exactly the puzzles they
+accepted, and skipping is not offered
+
+the counts given are only read, the skips are kept by the key being made
+
+***/
+
+// the skips allowed per puzzle when ChessOptions.MaxSkips is 0
+const DefaultMaxSkips = 5
+
+// the skips of a key being made, or being made again when replay is set
+type skips struct {
+	// the counts recorded when the key was made, nil while making it
+	replay []int
+	// the puzzles skipped (or passed over) for each puzzle of the key so far
+	counts []int
+	max    int
+}
+
+// the skips of a key of opts.Puzzles puzzles, replaying recorded when it is not nil
+func newSkips(opts ChessOptions, recorded []int) (*skips, error) {
+	if recorded != nil && len(recorded) > opts.Puzzles {
+		return nil, fmt.Errorf("%d chess skips recorded for %d puzzles", len(recorded), opts.Puzzles)
+	}
+	for i, n := range recorded {
+		if n < 0 || n > opts.MaxSkips {
+			return nil, fmt.Errorf("%d skips recorded for chess puzzle %d, at most %d are allowed", n, i+1, opts.MaxSkips)
+		}
+	}
+	s := &skips{counts: make([]int, opts.Puzzles), max: opts.MaxSkips}
+	if recorded != nil {
+		s.replay = append([]int{}, recorded...)
+	}
+	return s, nil
+}
+
+// whether the puzzle drawn for puzzle i was skipped when the key was made and is passed over
+func (s *skips) pass(i int) bool {
+	if i < len(s.replay) && s.counts[i] < s.replay[i] {
+		s.counts[i]++
+		return true
+	}
+	return false
+}
+
+// whether the solver may skip the puzzle drawn for puzzle i
+func (s *skips) allowed(i int) bool {
+	return s.replay == nil && s.counts[i] < s.max
+}
+
+// the solver skipped the puzzle drawn for puzzle i
+func (s *skips) skip(i int) {
+	s.counts[i]++
+}
+
+// the skips to store with the key
+func (s *skips) recorded() []int {
+	return append([]int{}, s.counts...)
+}
@@ -1,6 +1,7 @@
 package hashpuzzle
 
 import (
+	"captcha/captcha_lib/secret"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
@@ -31,8 +32,8 @@ func generateNonce(seed string) string {
 }
 
 // Generate a random string of a given length
-func generateString(seed string, length int) string {
-	s := HashNb([]byte(seed), 10, []byte("asdasd"))
+func generateString(seed []byte, length int) string {
+	s := HashNb(seed, 10, []byte("asdasd"))
 
 	rand.Seed(s)
 
@@ -66,8 +67,9 @@ func hashX(s string) string {
 }
 
 // Generate puzzle key
-func GenerateHashKey(seed string) string {
-	puzzle := generateString(seed, 10)
+// an empty key is returned when the solution is not accepted
+func GenerateHashKey(seed *secret.Secret) *secret.Secret {
+	puzzle := generateString(seed.Bytes(), 10)
 	fmt.Print("The Puzzle is :", puzzle, "\n\nEnter a nonce value which when appended makes the hash of the format \"000..\" : ")
 	var input int
 	fmt.Scanln(&input)
@@ -79,10 +81,17 @@ func GenerateHashKey(seed string) string {
 	if strings.HasPrefix(hx, difficulty) {
 		fmt.Println("\n\n\tSolution accepted")
 		nonce := generateNonce(puzzle)
-		result := puzzle + fmt.Sprint(nonce)
-		return result
+		return secret.New([]byte(puzzle + nonce))
 	} else {
 		fmt.Println("\n\n\tSolution not accepted, try again!")
 	}
-	return ""
+	return secret.New(nil)
+}
+
+// Generate the puzzle key without asking the user for a nonce
+// used when the key is wrapped for someone else who solves the puzzle later
+func SolveHashKey(seed *secret.Secret) *secret.Secret {
+	puzzle := generateString(seed.Bytes(), 10)
+	nonce := generateNonce(puzzle)
+	return secret.New([]byte(puzzle + nonce))
 }
@@ -0,0 +1,151 @@
+package passphrase
+
+import (
+	"bytes"
+	"captcha/captcha_lib/secret"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// the key captchazip used to fall back to when -key was not given
+// it is public so it is refused rather than silently protecting anything
+const DefaultKey = "thisisthedefault"
+
+var ErrDefaultKey = errors.New("refusing to use the built-in default key, choose your own passphrase")
+
+// where a passphrase comes from, at most one field should be set
+// with none set the passphrase is prompted for
+type Source struct {
+	// the passphrase itself (visible in shell history and ps output)
+	Key string
+	// a file whose first line is the passphrase
+	File string
+	// an environment variable holding the passphrase
+	Env string
+}
+
+// whether the passphrase is given explicitly instead of being prompted for
+func (s Source) Given() bool {
+	return s.Key != "" || s.File != "" || s.Env != ""
+}
+
+// read the passphrase from the source
+// prompt is shown when asking on the terminal, confirm asks a second time (for encryption)
+// the caller wipes the returned secret once the key is derived
+func (s Source) Read(prompt string, confirm bool) (*secret.Secret, error) {
+	var key *secret.Secret
+	var err error
+	switch {
+	case s.Key != "":
+		fmt.Fprintln(os.Stderr, "warning: a passphrase given with -key is visible in shell history and ps output")
+		key = secret.New([]byte(s.Key))
+	case s.File != "":
+		key, err = readFile(s.File)
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			err = fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+		key = secret.New([]byte(value))
+	default:
+		key, err = Prompt(prompt, confirm)
+	}
+	if err == nil {
+		err = Check(key.Bytes())
+	}
+	if err != nil {
+		key.Wipe()
+		return nil, err
+	}
+	return key, nil
+}
+
+// reject passphrases that protect nothing
+func Check(key []byte) error {
+	if len(key) == 0 {
+		return errors.New("empty passphrase")
+	}
+	if string(key) == DefaultKey {
+		return ErrDefaultKey
+	}
+	return nil
+}
+
+// read the first line of a key file
+func readFile(file string) (*secret.Secret, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file %s: %v", file, err)
+	}
+	defer secret.Wipe(content)
+	line := content
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return secret.Copy(bytes.TrimRight(line, "\r")), nil
+}
+
+// ask for the passphrase without echo
+// when stdin is not a terminal the passphrase is read as a line from stdin
+func Prompt(prompt string, confirm bool) (*secret.Secret, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return readLine(os.Stdin)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	key, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		defer secret.Wipe(again)
+		if err != nil {
+			secret.Wipe(key)
+			return nil, err
+		}
+		if !bytes.Equal(again, key) {
+			secret.Wipe(key)
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return secret.New(key), nil
+}
+
+// read a single line from f a byte at a time
+// stdin is shared with the puzzle prompts so nothing past the newline may be buffered
+func readLine(f *os.File) (*secret.Secret, error) {
+	line := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for {
+		n, err := f.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			// grow by hand so no copy of the passphrase is left behind
+			if len(line) == cap(line) {
+				grown := make([]byte, len(line), 2*cap(line))
+				copy(grown, line)
+				secret.Wipe(line)
+				line = grown
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if len(line) == 0 {
+				return nil, fmt.Errorf("reading passphrase from stdin: %v", err)
+			}
+			break
+		}
+	}
+	secret.Wipe(b)
+	return secret.New(bytes.TrimRight(line, "\r")), nil
+}
@@ -0,0 +1,89 @@
+package render
+
+import (
+	"fmt"
+
+	"github.com/notnil/chess"
+)
+
+// the share of the side left for the coordinates around a board
+const coordinateMargin = 0.06
+
+// draw the position in fen as a board
+func chessDrawing(fen string, opt Options) (*drawing, error) {
+	start, err := chess.FEN(fen)
+	if err != nil {
+		return nil, err
+	}
+	pos := chess.NewGame(start).Position()
+	var marked []chess.Square
+	if opt.LastMove != "" {
+		move, err := chess.UCINotation{}.Decode(nil, opt.LastMove)
+		if err != nil {
+			return nil, fmt.Errorf("last move %q is not in UCI", opt.LastMove)
+		}
+		marked = []chess.Square{move.S1(), move.S2()}
+	}
+
+	d, opt := newDrawing(opt)
+	margin := 0.0
+	if opt.Coordinates {
+		margin = d.side * coordinateMargin
+	}
+	cell := (d.side - margin) / 8
+	// the corner of a square, rank 8 at the top unless flipped
+	corner := func(sq chess.Square) (float64, float64) {
+		col, row := int(sq.File()), 7-int(sq.Rank())
+		if opt.Flip {
+			col, row = 7-col, 7-row
+		}
+		return margin + float64(col)*cell, float64(row) * cell
+	}
+
+	for sq := chess.A1; sq <= chess.H8; sq++ {
+		x, y := corner(sq)
+		c := opt.Theme.Light
+		if (int(sq.File())+int(sq.Rank()))%2 == 0 {
+			c = opt.Theme.Dark
+		}
+		d.rect(x, y, cell, cell, c, 1)
+		for _, m := range marked {
+			if m == sq {
+				d.rect(x, y, cell, cell, opt.Theme.Mark, 0.5)
+			}
+		}
+	}
+	for sq := chess.A1; sq <= chess.H8; sq++ {
+		if piece := pos.Board().Piece(sq); piece != chess.NoPiece {
+			x, y := corner(sq)
+			d.piece(x, y, cell, PieceElements(piece))
+		}
+	}
+	if opt.Coordinates {
+		for i := 0; i < 8; i++ {
+			x, y := corner(chess.NewSquare(chess.File(i), chess.Rank(i)))
+			d.text(x+cell/2, d.side-margin/2, margin*0.7, chess.File(i).String(), opt.Theme.Text, false)
+			d.text(margin/2, y+cell/2, margin*0.7, chess.Rank(i).String(), opt.Theme.Text, false)
+		}
+	}
+	d.clutter()
+	return d, nil
+}
+
+// the position in fen as an SVG image
+func ChessSVG(fen string, opt Options) ([]byte, error) {
+	d, err := chessDrawing(fen, opt)
+	if err != nil {
+		return nil, err
+	}
+	return d.svg(true), nil
+}
+
+// the position in fen as a PNG image
+func ChessPNG(fen string, opt Options) ([]byte, error) {
+	d, err := chessDrawing(fen, opt)
+	if err != nil {
+		return nil, err
+	}
+	return d.png()
+}
@@ -0,0 +1,74 @@
+package render
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+/***
+
+piece images
+
+the pieces are drawn as SVG in a 45 by 45 box, from shapes filled with the
+colour of their side, so the board front end and the image renderer draw
+the same pieces without image files
+
+***/
+
+// the size of the box a piece is drawn in
+const PieceBox = 45
+
+// the shapes of the pieces, drawn in the fill and outline of their side, {detail} is the colour of their details
+var pieceShapes = map[chess.PieceType]string{
+	chess.Pawn: `<circle cx="22.5" cy="14" r="5.5"/>` +
+		`<path d="M15 37 C15 30 18 26 20 21 L25 21 C27 26 30 30 30 37 Z"/>` +
+		`<rect x="11" y="36" width="23" height="4" rx="1.5"/>`,
+	chess.Rook: `<path d="M12 36 H33 V40 H12 Z M14 33 H31 L30 30 H15 Z M16 30 V17 H29 V30 Z M13 17 V10 H17 V13 H20 V10 H25 V13 H28 V10 H32 V17 Z"/>` +
+		`<path d="M16 20 H29" fill="none" stroke="{detail}"/>`,
+	chess.Bishop: `<circle cx="22.5" cy="8.5" r="2.5"/>` +
+		`<path d="M22.5 11 C16 16 15 22 17 27 H28 C30 22 29 16 22.5 11 Z"/>` +
+		`<rect x="15" y="27" width="15" height="3"/>` +
+		`<path d="M11 38 C15 35 19 33 22.5 33 C26 33 30 35 34 38 V40 H11 Z"/>` +
+		`<path d="M20.5 17 L24.5 21 M22.5 15 V24" fill="none" stroke="{detail}"/>`,
+	chess.Knight: `<path d="M12 39 H34 C34 30 33 22 29 16 C27 12 23 10 20 9 L19 12 L15 15 L9 25 L11 29 L15 27 L20 24 C19 29 14 32 12 39 Z"/>` +
+		`<circle cx="17" cy="17" r="1.3" fill="{detail}" stroke="none"/>` +
+		`<path d="M10 25.5 L12 24.5" fill="none" stroke="{detail}"/>`,
+	chess.Queen: `<path d="M9 27 L11 13 L16 24 L22.5 11 L29 24 L34 13 L36 27 C31 29.5 14 29.5 9 27 Z"/>` +
+		`<circle cx="11" cy="11" r="2.2"/><circle cx="22.5" cy="9" r="2.2"/><circle cx="34" cy="11" r="2.2"/>` +
+		`<path d="M11 28 C13 31 12.5 34 10.5 37 H34.5 C32.5 34 32 31 34 28 Z"/>` +
+		`<rect x="9" y="36" width="27" height="3.5" rx="1"/>` +
+		`<path d="M13 31.5 C19 33 26 33 32 31.5" fill="none" stroke="{detail}"/>`,
+	chess.King: `<path d="M21 4 H24 V7 H27 V10 H24 V15 H21 V10 H18 V7 H21 Z"/>` +
+		`<path d="M22.5 15 C17 15 10 18 10 24 C10 28 13 31 14 33 H31 C32 31 35 28 35 24 C35 18 28 15 22.5 15 Z"/>` +
+		`<rect x="12" y="33" width="21" height="6" rx="1"/>` +
+		`<path d="M14.5 29 C19 27 26 27 30.5 29 M22.5 17 V28" fill="none" stroke="{detail}"/>`,
+}
+
+// the fill, outline and detail colours of a side
+func pieceColors(c chess.Color) (string, string, string) {
+	if c == chess.Black {
+		return "#202020", "#000000", "#e8e8e8"
+	}
+	return "#ffffff", "#000000", "#000000"
+}
+
+// the SVG elements of piece, to place in a box of PieceBox
+func PieceElements(piece chess.Piece) string {
+	shape, ok := pieceShapes[piece.Type()]
+	if !ok {
+		return ""
+	}
+	fill, outline, detail := pieceColors(piece.Color())
+	return fmt.Sprintf(`<g fill="%s" stroke="%s" stroke-width="1.5" stroke-linejoin="round">`, fill, outline) +
+		strings.ReplaceAll(shape, "{detail}", detail) + `</g>`
+}
+
+// piece as an SVG image of its own, nil for no piece
+func PieceSVG(piece chess.Piece) []byte {
+	if piece == chess.NoPiece {
+		return nil
+	}
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="%[1]d" viewBox="0 0 %[1]d %[1]d">%[2]s</svg>`, PieceBox, PieceElements(piece)))
+}
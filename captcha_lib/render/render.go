@@ -0,0 +1,300 @@
+package render
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"math/rand"
+	"strings"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+/***
+
+puzzles rendered to images
+
+chess positions (from FEN) and sudoku grids are drawn to SVG or PNG so they
+can be served on a web page or sent by email. a drawing is made once as a
+list of shapes and written out either way: SVG as it is, PNG by rasterizing
+the shapes and drawing the text with the Go font
+
+noise hinders bots reading the image: the pieces and digits are moved and
+turned a little and lines and dots are drawn over the board. the noise is
+drawn from Seed so the same image can be made again, a Seed of 0 draws a
+random one
+
+use case: img, err := render.ChessPNG(fen, render.Options{Theme: render.Themes["classic"], Coordinates: true})
+
+***/
+
+// the colours of a drawing, as #rrggbb
+type Theme struct {
+	// the squares of a chess board
+	Light string
+	Dark  string
+	// covers the squares of the last move
+	Mark string
+	// around the board and the cells of a sudoku
+	Background string
+	// the lines of a sudoku
+	Line string
+	// coordinates and digits
+	Text string
+}
+
+// the themes built in, by name
+var Themes = map[string]Theme{
+	"classic": {Light: "#f0d9b5", Dark: "#b58863", Mark: "#ffe600", Background: "#ffffff", Line: "#000000", Text: "#333333"},
+	"green":   {Light: "#eeeed2", Dark: "#769656", Mark: "#f6f669", Background: "#ffffff", Line: "#1b3a12", Text: "#1b3a12"},
+	"blue":    {Light: "#dee3e6", Dark: "#8ca2ad", Mark: "#9bc700", Background: "#f4f7f9", Line: "#1f3a4d", Text: "#1f3a4d"},
+	"mono":    {Light: "#ffffff", Dark: "#bbbbbb", Mark: "#777777", Background: "#ffffff", Line: "#000000", Text: "#000000"},
+}
+
+// the theme used when none is given
+const DefaultTheme = "classic"
+
+// the side of an image when no Size is given
+const DefaultSize = 360
+
+// how a drawing is made
+type Options struct {
+	// the zero Theme is the default one
+	Theme Theme
+	// the side of the image in pixels
+	Size int
+	// draw the files and ranks around a chess board
+	Coordinates bool
+	// draw a chess board from black's side
+	Flip bool
+	// the move to mark on a chess board, in UCI (e.g. e2e4)
+	LastMove string
+	// from 0 (none) to 1
+	Noise float64
+	Seed  int64
+}
+
+// a shape of a drawing
+type shape struct {
+	kind string
+	// the box of a rect or piece, the ends of a line, the centre of a dot or text
+	x, y, w, h float64
+	color      string
+	opacity    float64
+	// the width of a line or the radius of a dot
+	width float64
+	// a text and its font size
+	text string
+	size float64
+	// the SVG elements of a piece, drawn in a box of PieceBox
+	piece string
+	// degrees around the centre of a piece or text
+	rotate float64
+}
+
+// a drawing of side by side pixels
+type drawing struct {
+	side   float64
+	shapes []shape
+	noise  *rand.Rand
+	level  float64
+}
+
+// a new drawing for opt with its background
+func newDrawing(opt Options) (*drawing, Options) {
+	if opt.Theme == (Theme{}) {
+		opt.Theme = Themes[DefaultTheme]
+	}
+	if opt.Size <= 0 {
+		opt.Size = DefaultSize
+	}
+	d := &drawing{side: float64(opt.Size), level: math.Max(0, math.Min(1, opt.Noise))}
+	seed := opt.Seed
+	if seed == 0 {
+		var b [8]byte
+		crand.Read(b[:])
+		seed = int64(binary.BigEndian.Uint64(b[:]))
+	}
+	d.noise = rand.New(rand.NewSource(seed))
+	d.rect(0, 0, d.side, d.side, opt.Theme.Background, 1)
+	return d, opt
+}
+
+func (d *drawing) rect(x, y, w, h float64, color string, opacity float64) {
+	d.shapes = append(d.shapes, shape{kind: "rect", x: x, y: y, w: w, h: h, color: color, opacity: opacity})
+}
+
+func (d *drawing) line(x1, y1, x2, y2, width float64, color string, opacity float64) {
+	d.shapes = append(d.shapes, shape{kind: "line", x: x1, y: y1, w: x2, h: y2, width: width, color: color, opacity: opacity})
+}
+
+// a text centred on x, y, moved and turned by the noise
+func (d *drawing) text(x, y, size float64, s string, color string, jitter bool) {
+	t := shape{kind: "text", x: x, y: y, size: size, text: s, color: color, opacity: 1}
+	if jitter {
+		t.x, t.y, t.rotate = d.jitter(x, y, size)
+	}
+	d.shapes = append(d.shapes, t)
+}
+
+// a piece in the box of side size at x, y, moved and turned by the noise
+func (d *drawing) piece(x, y, size float64, elements string) {
+	x, y, rotate := d.jitter(x, y, size)
+	d.shapes = append(d.shapes, shape{kind: "piece", x: x, y: y, w: size, h: size, piece: elements, rotate: rotate})
+}
+
+// move x, y by up to a tenth of size and draw a turn of up to 20 degrees, by the noise level
+func (d *drawing) jitter(x, y, size float64) (float64, float64, float64) {
+	if d.level == 0 {
+		return x, y, 0
+	}
+	shift := func() float64 { return (d.noise.Float64()*2 - 1) * d.level * size / 10 }
+	return x + shift(), y + shift(), (d.noise.Float64()*2 - 1) * d.level * 20
+}
+
+// lines and dots over the drawing, by the noise level
+func (d *drawing) clutter() {
+	if d.level == 0 {
+		return
+	}
+	gray := func() string {
+		v := 40 + d.noise.Intn(150)
+		return fmt.Sprintf("#%02x%02x%02x", v, v, v)
+	}
+	for i := 0; i < int(d.level*10)+1; i++ {
+		at := func() float64 { return d.noise.Float64() * d.side }
+		d.line(at(), at(), at(), at(), 1+d.noise.Float64()*d.side/200, gray(), 0.6)
+	}
+	for i := 0; i < int(d.level*d.side/2); i++ {
+		r := 0.5 + d.noise.Float64()*d.side/250
+		d.shapes = append(d.shapes, shape{kind: "dot", x: d.noise.Float64() * d.side, y: d.noise.Float64() * d.side, width: r, color: gray(), opacity: 0.7})
+	}
+}
+
+// the drawing as SVG, text is left out when drawn otherwise
+func (d *drawing) svg(text bool) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]g" height="%[1]g" viewBox="0 0 %[1]g %[1]g">`, d.side)
+	for _, s := range d.shapes {
+		switch s.kind {
+		case "rect":
+			fmt.Fprintf(&b, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" fill="%s" fill-opacity="%g"/>`, s.x, s.y, s.w, s.h, s.color, s.opacity)
+		case "line":
+			fmt.Fprintf(&b, `<path d="M%.2f %.2f L%.2f %.2f" stroke="%s" stroke-width="%.2f" stroke-opacity="%g" stroke-linecap="round"/>`, s.x, s.y, s.w, s.h, s.color, s.width, s.opacity)
+		case "dot":
+			fmt.Fprintf(&b, `<circle cx="%.2f" cy="%.2f" r="%.2f" fill="%s" fill-opacity="%g"/>`, s.x, s.y, s.width, s.color, s.opacity)
+		case "piece":
+			// scaled into the box and turned around its centre, as one matrix for the rasterizer
+			scale := s.w / PieceBox
+			sin, cos := math.Sincos(s.rotate * math.Pi / 180)
+			cx, cy := s.w/2, s.h/2
+			e, f := s.x+cx-(cos*cx-sin*cy), s.y+cy-(sin*cx+cos*cy)
+			fmt.Fprintf(&b, `<g transform="matrix(%.4f,%.4f,%.4f,%.4f,%.2f,%.2f)">%s</g>`, scale*cos, scale*sin, -scale*sin, scale*cos, e, f, s.piece)
+		case "text":
+			if text {
+				fmt.Fprintf(&b, `<text x="%.2f" y="%.2f" font-family="sans-serif" font-weight="bold" font-size="%.2f" fill="%s" text-anchor="middle" dominant-baseline="central" transform="rotate(%.2f %.2f %.2f)">%s</text>`, s.x, s.y, s.size, s.color, s.rotate, s.x, s.y, s.text)
+			}
+		}
+	}
+	b.WriteString(`</svg>`)
+	return []byte(b.String())
+}
+
+// the drawing as PNG, the shapes are rasterized from the SVG and the text drawn over them
+func (d *drawing) png() ([]byte, error) {
+	side := int(d.side)
+	img := image.NewRGBA(image.Rect(0, 0, side, side))
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(d.svg(false)))
+	if err != nil {
+		return nil, err
+	}
+	icon.SetTarget(0, 0, d.side, d.side)
+	scanner := rasterx.NewScannerGV(side, side, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(side, side, scanner), 1)
+
+	ttf, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range d.shapes {
+		if s.kind != "text" {
+			continue
+		}
+		if err := drawText(img, ttf, s); err != nil {
+			return nil, err
+		}
+	}
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// draw a text shape on img, turned by drawing it on its own and rotating it over
+func drawText(img *image.RGBA, ttf *opentype.Font, s shape) error {
+	face, err := opentype.NewFace(ttf, &opentype.FaceOptions{Size: s.size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+	c, err := parseColor(s.color)
+	if err != nil {
+		return err
+	}
+	// the text is drawn centred in a square of its own
+	box := int(s.size * 2)
+	tile := image.NewRGBA(image.Rect(0, 0, box, box))
+	metrics := face.Metrics()
+	dr := font.Drawer{Dst: tile, Src: image.NewUniform(c), Face: face}
+	width := dr.MeasureString(s.text)
+	dr.Dot = fixed.Point26_6{
+		X: fixed.I(box/2) - width/2,
+		Y: fixed.I(box/2) + (metrics.Ascent-metrics.Descent)/2,
+	}
+	dr.DrawString(s.text)
+
+	// copy the tile over img around the centre, turned by rotate
+	sin, cos := math.Sincos(-s.rotate * math.Pi / 180)
+	half := float64(box) / 2
+	for y := 0; y < box; y++ {
+		for x := 0; x < box; x++ {
+			// the pixel of the tile shown at x, y
+			dx, dy := float64(x)-half+0.5, float64(y)-half+0.5
+			tx, ty := int(math.Floor(dx*cos-dy*sin+half)), int(math.Floor(dx*sin+dy*cos+half))
+			if tx < 0 || ty < 0 || tx >= box || ty >= box {
+				continue
+			}
+			src := tile.RGBAAt(tx, ty)
+			if src.A == 0 {
+				continue
+			}
+			px, py := int(s.x-half)+x, int(s.y-half)+y
+			if !(image.Point{px, py}.In(img.Bounds())) {
+				continue
+			}
+			draw.Draw(img, image.Rect(px, py, px+1, py+1), image.NewUniform(src), image.Point{}, draw.Over)
+		}
+	}
+	return nil
+}
+
+// a colour given as #rrggbb
+func parseColor(s string) (color.RGBA, error) {
+	var r, g, b uint8
+	if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b); err != nil {
+		return color.RGBA{}, fmt.Errorf("colour %q is not #rrggbb", s)
+	}
+	return color.RGBA{R: r, G: g, B: b, A: 255}, nil
+}
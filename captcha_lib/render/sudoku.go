@@ -0,0 +1,58 @@
+package render
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// the digits of a sudoku grid, 0 for an empty cell
+// a sudoku.Grid is given as it is
+type Grid = [9][9]int
+
+// draw the grid, the coordinates, flip and last move of opt are not used
+func sudokuDrawing(g Grid, opt Options) (*drawing, error) {
+	d, opt := newDrawing(opt)
+	// a border around the grid as wide as the thick lines
+	border := d.side / 60
+	cell := (d.side - 2*border) / 9
+	for row := range g {
+		for col, n := range g[row] {
+			if n < 0 || n > 9 {
+				return nil, fmt.Errorf("cell %d,%d holds %d, not a digit", row+1, col+1, n)
+			}
+			if n != 0 {
+				x, y := border+(float64(col)+0.5)*cell, border+(float64(row)+0.5)*cell
+				d.text(x, y, cell*0.6, strconv.Itoa(n), opt.Theme.Text, true)
+			}
+		}
+	}
+	for i := 0; i <= 9; i++ {
+		width := d.side / 300
+		if i%3 == 0 {
+			width = border
+		}
+		at := border + float64(i)*cell
+		d.line(border, at, d.side-border, at, width, opt.Theme.Line, 1)
+		d.line(at, border, at, d.side-border, width, opt.Theme.Line, 1)
+	}
+	d.clutter()
+	return d, nil
+}
+
+// the grid as an SVG image
+func SudokuSVG(g Grid, opt Options) ([]byte, error) {
+	d, err := sudokuDrawing(g, opt)
+	if err != nil {
+		return nil, err
+	}
+	return d.svg(true), nil
+}
+
+// the grid as a PNG image
+func SudokuPNG(g Grid, opt Options) ([]byte, error) {
+	d, err := sudokuDrawing(g, opt)
+	if err != nil {
+		return nil, err
+	}
+	return d.png()
+}
@@ -0,0 +1,98 @@
+package secret
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// names of key material, which must not be carried in a string
+var keyName = regexp.MustCompile(`(?i)key|pass|pwd|secret|solution|answer`)
+
+// the strings named like key material that hold none
+var notKeys = map[string]string{
+	"KeySlot.Key": "the data key sealed under the slot key",
+	"Source.Key":  "a passphrase given on the command line, a string in os.Args already",
+	"SplitKey":    "the names of the share files",
+}
+
+// whether expr is a string or a slice or array of them
+func isString(expr ast.Expr) bool {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t.Name == "string"
+	case *ast.ArrayType:
+		return isString(t.Elt)
+	case *ast.StarExpr:
+		return isString(t.X)
+	}
+	return false
+}
+
+// report the string fields of list named like key material
+// with results set every string is reported, list being the results of a function named like key material
+func auditFields(t *testing.T, fset *token.FileSet, where string, list *ast.FieldList, results bool) {
+	if list == nil {
+		return
+	}
+	for _, field := range list.List {
+		if !isString(field.Type) {
+			continue
+		}
+		if results {
+			if _, ok := notKeys[where]; !ok {
+				t.Errorf("%s: %s returns a string", fset.Position(field.Pos()), where)
+			}
+			continue
+		}
+		for _, name := range field.Names {
+			if _, ok := notKeys[where+"."+name.Name]; ok {
+				continue
+			}
+			if keyName.MatchString(name.Name) {
+				t.Errorf("%s: %s carries %s in a string", fset.Position(name.Pos()), where, name.Name)
+			}
+		}
+	}
+}
+
+// the functions and struct fields of the library must not take or give key material as strings
+func TestNoKeysInStrings(t *testing.T) {
+	fset := token.NewFileSet()
+	err := filepath.WalkDir("..", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				where := n.Name.Name
+				auditFields(t, fset, where, n.Type.Params, false)
+				auditFields(t, fset, where, n.Type.Results, keyName.MatchString(n.Name.Name))
+			case *ast.FuncLit:
+				auditFields(t, fset, "a function literal", n.Type.Params, false)
+			case *ast.TypeSpec:
+				if st, ok := n.Type.(*ast.StructType); ok {
+					auditFields(t, fset, n.Name.Name, st.Fields, false)
+				}
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
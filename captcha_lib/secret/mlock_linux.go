@@ -0,0 +1,61 @@
+//go:build linux
+
+package secret
+
+import (
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// the secrets locked on each page, by page address
+// munlock unlocks whole pages and doesn't count, a page is only unlocked when its last secret is
+var pages = struct {
+	sync.Mutex
+	count map[uintptr]int
+}{count: map[uintptr]int{}}
+
+// the addresses of the pages b spans
+func pagesOf(b []byte) []uintptr {
+	size := uintptr(os.Getpagesize())
+	start := uintptr(unsafe.Pointer(&b[0]))
+	var spanned []uintptr
+	for p := start &^ (size - 1); p < start+uintptr(len(b)); p += size {
+		spanned = append(spanned, p)
+	}
+	return spanned
+}
+
+// keep b out of swap, fails without CAP_IPC_LOCK once RLIMIT_MEMLOCK is used up
+func lock(b []byte) bool {
+	pages.Lock()
+	defer pages.Unlock()
+	if unix.Mlock(b) != nil {
+		return false
+	}
+	for _, p := range pagesOf(b) {
+		pages.count[p]++
+	}
+	return true
+}
+
+// release the lock of b, the pages it shares with other locked secrets stay locked
+func unlock(b []byte) {
+	pages.Lock()
+	defer pages.Unlock()
+	size := uintptr(os.Getpagesize())
+	start := uintptr(unsafe.Pointer(&b[0]))
+	for _, p := range pagesOf(b) {
+		pages.count[p]--
+		if pages.count[p] > 0 {
+			continue
+		}
+		delete(pages.count, p)
+		// the part of b on page p, munlock rounds it out to the page
+		from := max(p, start) - start
+		to := min(p+size, start+uintptr(len(b))) - start
+		unix.Munlock(b[from:to])
+	}
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package secret
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// the kB of memory locked by the process
+func lockedKB(t *testing.T) string {
+	t.Helper()
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "VmLck:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "VmLck:"))
+		}
+	}
+	t.Skip("no VmLck in /proc/self/status")
+	return ""
+}
+
+// wiping a secret keeps the page it shares with another locked secret locked
+func TestWipeKeepsSharedPageLocked(t *testing.T) {
+	Lock = true
+	defer func() { Lock = false }()
+	before := lockedKB(t)
+	b := make([]byte, 64)
+	first, second := New(b[:32:32]), New(b[32:])
+	if !first.locked || !second.locked {
+		t.Skip("memory can't be locked here")
+	}
+	locked := lockedKB(t)
+	if locked == before {
+		t.Fatalf("locking two secrets left %s locked", locked)
+	}
+	first.Wipe()
+	if got := lockedKB(t); got != locked {
+		t.Errorf("wiping one secret of a page left %s locked, want %s", got, locked)
+	}
+	second.Wipe()
+	if got := lockedKB(t); got != before {
+		t.Errorf("wiping both secrets left %s locked, want %s", got, before)
+	}
+}
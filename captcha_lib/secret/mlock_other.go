@@ -0,0 +1,10 @@
+//go:build !linux
+
+package secret
+
+// memory locking is only supported on linux
+func lock(b []byte) bool {
+	return false
+}
+
+func unlock(b []byte) {}
@@ -0,0 +1,106 @@
+package secret
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+/***
+
+key material (passwords, puzzle keys, data keys) is carried in a Secret
+instead of a string so it can be wiped once it is no longer needed.
+go strings are immutable and stay in memory until the garbage collector
+reuses them, a Secret is zeroed by Wipe
+
+***/
+
+// when set new secrets are locked into memory so they are never swapped out (linux only)
+var Lock bool
+
+// a buffer of key material that is wiped after use
+type Secret struct {
+	b      []byte
+	locked bool
+}
+
+// take ownership of b, the caller must not use b afterwards
+func New(b []byte) *Secret {
+	s := &Secret{b: b}
+	if Lock && len(b) > 0 {
+		s.locked = lock(b)
+	}
+	return s
+}
+
+// copy b into a new secret, b itself is left for the caller to wipe
+func Copy(b []byte) *Secret {
+	return New(append([]byte(nil), b...))
+}
+
+// the concatenation of parts in a new secret, nil parts are skipped
+func Concat(parts ...*Secret) *Secret {
+	n := 0
+	for _, p := range parts {
+		n += p.Len()
+	}
+	b := make([]byte, 0, n)
+	for _, p := range parts {
+		b = append(b, p.Bytes()...)
+	}
+	return New(b)
+}
+
+// the hex encoding of b in a new secret
+func Hex(b []byte) *Secret {
+	out := make([]byte, hex.EncodedLen(len(b)))
+	hex.Encode(out, b)
+	return New(out)
+}
+
+// the key material, valid until Wipe
+// a nil secret holds nothing
+func (s *Secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.b
+}
+
+// the length of the key material
+func (s *Secret) Len() int {
+	return len(s.Bytes())
+}
+
+// whether the secret holds nothing
+func (s *Secret) Empty() bool {
+	return s.Len() == 0
+}
+
+// compare with b in constant time
+func (s *Secret) Equal(b []byte) bool {
+	return subtle.ConstantTimeCompare(s.Bytes(), b) == 1
+}
+
+// a copy that is wiped independently of s
+func (s *Secret) Clone() *Secret {
+	return Copy(s.Bytes())
+}
+
+// zero the key material and release it, the secret is empty afterwards
+// wiping a nil or already wiped secret does nothing
+func (s *Secret) Wipe() {
+	if s == nil || s.b == nil {
+		return
+	}
+	Wipe(s.b)
+	if s.locked {
+		unlock(s.b)
+		s.locked = false
+	}
+	s.b = nil
+}
+
+// zero b, for key material that never made it into a Secret
+func Wipe(b []byte) {
+	clear(b)
+}
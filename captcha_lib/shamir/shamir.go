@@ -0,0 +1,135 @@
+package shamir
+
+import (
+	"captcha/captcha_lib/secret"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/***
+
+Shamir secret sharing over GF(256)
+
+every byte of the secret is the constant term of its own random polynomial
+of degree k-1, a share holds the value of every polynomial at one x. any k
+shares find the polynomials again by Lagrange interpolation at x = 0, fewer
+than k tell nothing about the secret
+
+a share is its x (1..255) followed by one byte per byte of the secret
+
+the field is GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1,
+multiplication goes through log and exp tables of the generator 3
+
+***/
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		expTable[i+255] = x
+		logTable[x] = byte(i)
+		// multiply by the generator 3: x*2 + x, reduced by the polynomial
+		double := x << 1
+		if x&0x80 != 0 {
+			double ^= 0x1b
+		}
+		x ^= double
+	}
+}
+
+// the product of a and b in GF(256)
+func mul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// a divided by b in GF(256), b is never 0
+func div(a byte, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+// the value at x of the polynomial with coefficients (lowest first)
+func eval(coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coefficients[i]
+	}
+	return y
+}
+
+// split data (a secret) into n shares any k of which recover it
+func Split(data []byte, n int, k int) ([][]byte, error) {
+	if k < 2 || k > n || n > 255 {
+		return nil, fmt.Errorf("cannot split into %d shares with a threshold of %d (2 <= threshold <= shares <= 255)", n, k)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, 1+len(data))
+		shares[i][0] = byte(i + 1)
+	}
+	coefficients := make([]byte, k)
+	defer secret.Wipe(coefficients)
+	for j, b := range data {
+		coefficients[0] = b
+		_, err := io.ReadFull(rand.Reader, coefficients[1:])
+		if err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			share[1+j] = eval(coefficients, share[0])
+		}
+	}
+	return shares, nil
+}
+
+// recover the secret from at least the threshold of its shares
+// too few shares give a wrong secret, not an error, the caller has to check it
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are needed")
+	}
+	size := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) < 2 || len(share) != size {
+			return nil, errors.New("the shares are of different lengths")
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, fmt.Errorf("share %d is given twice or is invalid", share[0])
+		}
+		seen[share[0]] = true
+	}
+
+	// the Lagrange basis of every share at x = 0
+	basis := make([]byte, len(shares))
+	for i, si := range shares {
+		basis[i] = 1
+		for j, sj := range shares {
+			if i != j {
+				basis[i] = mul(basis[i], div(sj[0], sj[0]^si[0]))
+			}
+		}
+	}
+	data := make([]byte, size-1)
+	for j := range data {
+		for i, share := range shares {
+			data[j] ^= mul(basis[i], share[1+j])
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,90 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+// the subsets of k of the indices 0..n-1
+func subsets(n int, k int) [][]int {
+	if k == 0 {
+		return [][]int{nil}
+	}
+	var all [][]int
+	for i := k - 1; i < n; i++ {
+		for _, s := range subsets(i, k-1) {
+			all = append(all, append(s, i))
+		}
+	}
+	return all
+}
+
+// a random secret split into n shares with a threshold of k
+func split(t *testing.T, n int, k int) ([]byte, [][]byte) {
+	t.Helper()
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	shares, err := Split(data, n, k)
+	if err != nil {
+		t.Fatalf("splitting into %d of %d: %v", k, n, err)
+	}
+	return data, shares
+}
+
+// the shares at indices
+func pick(shares [][]byte, indices []int) [][]byte {
+	var picked [][]byte
+	for _, i := range indices {
+		picked = append(picked, shares[i])
+	}
+	return picked
+}
+
+func TestAnyThresholdRecovers(t *testing.T) {
+	data, shares := split(t, 5, 3)
+	for _, s := range subsets(5, 3) {
+		got, err := Combine(pick(shares, s))
+		if err != nil {
+			t.Fatalf("combining shares %v: %v", s, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("shares %v combine into a different secret", s)
+		}
+	}
+	// more shares than the threshold recover it too
+	got, err := Combine(shares)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("all shares combine into a different secret (%v)", err)
+	}
+}
+
+func TestTooFewShares(t *testing.T) {
+	data, shares := split(t, 5, 3)
+	for _, s := range subsets(5, 2) {
+		got, err := Combine(pick(shares, s))
+		if err != nil {
+			t.Fatalf("combining shares %v: %v", s, err)
+		}
+		if bytes.Equal(got, data) {
+			t.Errorf("shares %v below the threshold recover the secret", s)
+		}
+	}
+}
+
+func TestInvalidShares(t *testing.T) {
+	_, shares := split(t, 3, 2)
+	zero := append([]byte{0}, shares[1][1:]...)
+	cases := map[string][][]byte{
+		"a share given twice": {shares[0], shares[0]},
+		"two shares at one x": {shares[0], append([]byte{shares[0][0]}, shares[1][1:]...)},
+		"a share at x = 0":    {shares[0], zero},
+	}
+	for name, given := range cases {
+		if _, err := Combine(given); err == nil {
+			t.Errorf("combined %s", name)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package strength
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+/***
+
+zxcvbn style password strength estimation
+
+the password is covered by the cheapest sequence of patterns an attacker
+would try (dictionary words, l33t and capitalised variants, keyboard walks,
+sequences, repeats and years/dates) with brute force filling the gaps. the
+estimate is log2 of the number of guesses needed
+
+***/
+
+// the result of estimating a password
+type Result struct {
+	// log2 of the estimated number of guesses
+	Bits float64
+	// the patterns found, shown to the user as hints
+	Feedback []string
+}
+
+// a pattern covering password[i:j] that costs guesses (log2) to find
+type match struct {
+	i, j    int
+	bits    float64
+	pattern string
+}
+
+// most common passwords first, the rank is the number of guesses
+var commonPasswords = []string{
+	"password", "123456", "12345678", "qwerty", "123456789", "12345", "1234", "111111",
+	"1234567", "dragon", "123123", "baseball", "abc123", "football", "monkey", "letmein",
+	"696969", "shadow", "master", "666666", "qwertyuiop", "123321", "mustang", "1234567890",
+	"michael", "654321", "superman", "1qaz2wsx", "7777777", "121212", "000000", "qazwsx",
+	"123qwe", "killer", "trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter",
+	"buster", "soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou",
+	"2000", "charlie", "robert", "thomas", "hockey", "ranger", "daniel", "starwars",
+	"klaster", "112233", "george", "computer", "michelle", "jessica", "pepper", "1111",
+	"zxcvbn", "555555", "11111111", "131313", "freedom", "777777", "pass", "maggie",
+	"159753", "aaaaaa", "ginger", "princess", "joshua", "cheese", "amanda", "summer",
+	"love", "ashley", "nicole", "chelsea", "biteme", "matthew", "access", "yankees",
+	"987654321", "dallas", "austin", "thunder", "taylor", "matrix", "admin", "welcome",
+	"login", "passw0rd", "secret", "changeme", "default", "thisisthedefault", "captcha",
+	"sudoku", "chess", "puzzle", "hello", "whatever", "qwerty123", "password1",
+}
+
+// common english words, ranked after the passwords
+var commonWords = []string{
+	"the", "this", "that", "with", "have", "from", "they", "will", "would", "there",
+	"their", "what", "about", "which", "when", "make", "like", "time", "just", "know",
+	"take", "people", "into", "year", "your", "good", "some", "could", "them", "see",
+	"other", "than", "then", "now", "look", "only", "come", "over", "think", "also",
+	"back", "after", "use", "two", "how", "our", "work", "first", "well", "way",
+	"even", "new", "want", "because", "any", "these", "give", "day", "most", "cat",
+	"dog", "house", "water", "fire", "earth", "money", "music", "world", "life", "family",
+	"friend", "happy", "blue", "red", "green", "black", "white", "orange", "apple", "banana",
+	"summer", "winter", "spring", "autumn", "secure", "security", "key", "lock", "open", "door",
+	"guide", "galaxy", "hitchhiker", "towel", "answer", "forty", "two", "universe", "is", "default",
+}
+
+// keyboard rows used to detect walks such as "qwer" or "asdf"
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+	"~!@#$%^&*()_+", "QWERTYUIOP{}|", "ASDFGHJKL:\"", "ZXCVBNM<>?",
+}
+
+var leet = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i', '!': 'i',
+	'0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z',
+}
+
+// the dictionary with each word mapped to its rank
+var ranked map[string]int
+
+func init() {
+	ranked = make(map[string]int)
+	for i, w := range commonPasswords {
+		if _, ok := ranked[w]; !ok {
+			ranked[w] = i + 1
+		}
+	}
+	for i, w := range commonWords {
+		if _, ok := ranked[w]; !ok {
+			ranked[w] = len(commonPasswords) + i + 1
+		}
+	}
+}
+
+// the size of the alphabet an attacker brute forcing the password has to use
+func cardinality(pw []rune) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range pw {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < 128:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	c := 0.0
+	if lower {
+		c += 26
+	}
+	if upper {
+		c += 26
+	}
+	if digit {
+		c += 10
+	}
+	if symbol {
+		c += 33
+	}
+	if other {
+		c += 100
+	}
+	if c == 0 {
+		c = 1
+	}
+	return c
+}
+
+// dictionary words, with capitalisation and l33t variants
+func dictionaryMatches(pw []rune) []match {
+	var matches []match
+	for i := 0; i < len(pw); i++ {
+		for j := i + 3; j <= len(pw); j++ {
+			word := pw[i:j]
+			lower := strings.ToLower(string(word))
+			unleet := []rune(lower)
+			leeted := false
+			for k, r := range unleet {
+				if sub, ok := leet[r]; ok {
+					unleet[k] = sub
+					leeted = true
+				}
+			}
+			for _, candidate := range []string{lower, string(unleet)} {
+				rank, ok := ranked[candidate]
+				if !ok {
+					continue
+				}
+				bits := math.Log2(float64(rank))
+				pattern := "dictionary word " + candidate
+				if lower != string(word) {
+					// capitalised words cost a little more, mixed case a bit more again
+					if unicode.IsUpper(word[0]) && strings.ToLower(string(word[1:])) == string(word[1:]) {
+						bits += 1
+					} else {
+						bits += math.Log2(float64(len(word)))
+					}
+				}
+				if leeted && candidate != lower {
+					bits += 1
+					pattern = "l33t " + pattern
+				}
+				matches = append(matches, match{i, j, bits, pattern})
+			}
+		}
+	}
+	return matches
+}
+
+// runs of three or more characters repeating the same step (abc, 9876, aaaa)
+func sequenceMatches(pw []rune) []match {
+	var matches []match
+	i := 0
+	for i < len(pw)-2 {
+		delta := pw[i+1] - pw[i]
+		j := i + 1
+		for j < len(pw) && pw[j]-pw[j-1] == delta && delta >= -2 && delta <= 2 {
+			j++
+		}
+		if j-i >= 3 {
+			base := 26.0
+			if unicode.IsDigit(pw[i]) {
+				base = 10
+			}
+			pattern := "sequence " + string(pw[i:j])
+			if delta == 0 {
+				pattern = "repeated " + string(pw[i:i+1])
+			}
+			matches = append(matches, match{i, j, math.Log2(base * float64(j-i)), pattern})
+			i = j - 1
+			continue
+		}
+		i++
+	}
+	return matches
+}
+
+// runs of four or more adjacent keys on a keyboard row
+func keyboardMatches(pw []rune) []match {
+	var matches []match
+	for i := 0; i < len(pw); i++ {
+		for _, row := range keyboardRows {
+			k := strings.IndexRune(row, pw[i])
+			if k < 0 {
+				continue
+			}
+			j := i + 1
+			for j < len(pw) && k+(j-i) < len(row) && rune(row[k+(j-i)]) == pw[j] {
+				j++
+			}
+			if j-i >= 4 {
+				matches = append(matches, match{i, j, math.Log2(float64(len(keyboardRows)*len(row)) * float64(j-i)), "keyboard walk " + string(pw[i:j])})
+			}
+		}
+	}
+	return matches
+}
+
+// years 1900-2039 and eight digit dates
+func dateMatches(pw []rune) []match {
+	var matches []match
+	for i := 0; i+4 <= len(pw); i++ {
+		s := string(pw[i : i+4])
+		if (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20")) && isDigits(s) && s < "2040" {
+			matches = append(matches, match{i, i + 4, math.Log2(140), "year " + s})
+		}
+		if i+8 <= len(pw) && isDigits(string(pw[i:i+8])) {
+			matches = append(matches, match{i, i + 8, math.Log2(366 * 140), "date " + string(pw[i:i+8])})
+		}
+	}
+	return matches
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// repeats of a whole block such as "abcabc"
+func repeatMatches(pw []rune) []match {
+	var matches []match
+	for i := 0; i < len(pw); i++ {
+		for size := 2; i+2*size <= len(pw); size++ {
+			block := string(pw[i : i+size])
+			j := i + size
+			for j+size <= len(pw) && string(pw[j:j+size]) == block {
+				j += size
+			}
+			if j-i >= 2*size {
+				count := float64((j - i) / size)
+				bits := float64(size)*math.Log2(cardinality([]rune(block))) + math.Log2(count)
+				matches = append(matches, match{i, j, bits, "repeated block " + block})
+			}
+		}
+	}
+	return matches
+}
+
+// estimate the number of guesses (in bits) needed to find pw
+// pw is only read, wiping it stays with the caller
+func Estimate(pw []byte) Result {
+	runes := bytes.Runes(pw)
+	defer clear(runes)
+	if len(runes) == 0 {
+		return Result{Bits: 0, Feedback: []string{"empty password"}}
+	}
+	bruteBits := math.Log2(cardinality(runes))
+
+	var matches []match
+	matches = append(matches, dictionaryMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, dateMatches(runes)...)
+	matches = append(matches, repeatMatches(runes)...)
+
+	// best[j] is the cheapest cover of runes[:j], from[j] the match ending it (-1 brute force)
+	best := make([]float64, len(runes)+1)
+	from := make([]int, len(runes)+1)
+	for j := 1; j <= len(runes); j++ {
+		best[j] = best[j-1] + bruteBits
+		from[j] = -1
+		for k, m := range matches {
+			if m.j == j && best[m.i]+m.bits < best[j] {
+				best[j] = best[m.i] + m.bits
+				from[j] = k
+			}
+		}
+	}
+
+	var result Result
+	result.Bits = best[len(runes)]
+	for j := len(runes); j > 0; {
+		if from[j] < 0 {
+			j--
+			continue
+		}
+		m := matches[from[j]]
+		result.Feedback = append([]string{m.pattern}, result.Feedback...)
+		j = m.i
+	}
+	// each extra pattern means another choice for the attacker
+	if len(result.Feedback) > 1 {
+		result.Bits += math.Log2(float64(len(result.Feedback)))
+	}
+	return result
+}
+
+// a password policy enforced when encrypting
+type Policy struct {
+	// the minimum estimated entropy in bits
+	MinBits float64
+	// passwords that are refused outright (compared case insensitively)
+	Blocklist []string
+}
+
+// the policy used unless configured otherwise
+var DefaultPolicy = Policy{
+	MinBits:   50,
+	Blocklist: []string{"thisisthedefault"},
+}
+
+// the number of SHA-256 evaluations per second assumed for an offline attacker
+// (a single modern GPU)
+const AttackerHashRate = 1e10
+
+// describe the overall work factor for a password hashed N times
+// the puzzles are generated from the password so an attacker regenerates and
+// solves them automatically, they add only a little extra work per guess
+func WorkFactor(bits float64, N uint16) string {
+	total := bits + math.Log2(float64(N))
+	seconds := math.Pow(2, total) / AttackerHashRate / 2
+	return fmt.Sprintf("about %.0f bits of password entropy plus %d hash iterations (%.0f bits total), "+
+		"roughly %s on average for an attacker at %.0e hashes/second; the puzzles are derived from the password "+
+		"and can be solved automatically, so they add little to this",
+		bits, N, total, Duration(seconds), AttackerHashRate)
+}
+
+// format a number of seconds as a human readable duration
+func Duration(seconds float64) string {
+	units := []struct {
+		name string
+		size float64
+	}{
+		{"years", 365.25 * 24 * 3600}, {"days", 24 * 3600}, {"hours", 3600}, {"minutes", 60},
+	}
+	if math.IsInf(seconds, 1) || seconds > 1e30 {
+		return "longer than the age of the universe"
+	}
+	for _, u := range units {
+		if seconds >= u.size {
+			return fmt.Sprintf("%.3g %s", seconds/u.size, u.name)
+		}
+	}
+	if seconds < 1 {
+		return "less than a second"
+	}
+	return fmt.Sprintf("%.3g seconds", seconds)
+}
+
+// check pw against the policy, N is the number of hash iterations it will be used with
+func (p Policy) Check(pw []byte, N uint16) error {
+	for _, blocked := range p.Blocklist {
+		if bytes.EqualFold(pw, []byte(blocked)) {
+			return fmt.Errorf("the password is on the blocklist")
+		}
+	}
+	result := Estimate(pw)
+	if result.Bits < p.MinBits {
+		msg := fmt.Sprintf("the password is too weak: %s; at least %.0f bits are required", WorkFactor(result.Bits, N), p.MinBits)
+		if len(result.Feedback) > 0 {
+			msg += " (found " + strings.Join(result.Feedback, ", ") + ")"
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package strength
+
+import "testing"
+
+func TestWeakPasswords(t *testing.T) {
+	weak := []string{
+		"thisisthedefault", // blocklisted
+		"password1",
+		"qwertyuiop",
+		"19841984",
+		"P@ssw0rd",
+		"abcdefgh",
+		"Summer2024",
+		"aaaaaaaaaaaa",
+	}
+	for _, pw := range weak {
+		if bits := Estimate([]byte(pw)).Bits; bits >= DefaultPolicy.MinBits {
+			t.Errorf("%q estimated at %.1f bits, at least %.0f", pw, bits, DefaultPolicy.MinBits)
+		}
+		if err := DefaultPolicy.Check([]byte(pw), 1000); err == nil {
+			t.Errorf("%q passed the default policy", pw)
+		}
+	}
+}
+
+func TestStrongPassphrase(t *testing.T) {
+	pw := []byte("tq8#Vw2-mZ/kr9Lx!4bN%ye7Pj")
+	if bits := Estimate(pw).Bits; bits < DefaultPolicy.MinBits {
+		t.Errorf("%q estimated at %.1f bits, below %.0f", pw, bits, DefaultPolicy.MinBits)
+	}
+	if err := DefaultPolicy.Check(pw, 1000); err != nil {
+		t.Errorf("%q failed the default policy: %v", pw, err)
+	}
+}
@@ -2,6 +2,8 @@ package sudoku
 
 import (
 	"bytes"
+	"captcha/captcha_lib/board"
+	"captcha/captcha_lib/secret"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
@@ -12,7 +14,6 @@ import (
 	"strconv"
 
 	"fyne.io/fyne/v2"
-	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/theme"
@@ -21,7 +22,7 @@ import (
 
 /***
 
-use case: K = sudoku.Test(*keystr, uint16(*N))
+use case: K := sudoku.GetPuzzleKey(key, uint16(*N)), K.Wipe() when done
 
 ***/
 
@@ -51,11 +52,11 @@ type Grid [N][N]int
 //		fmt.Println()
 //	}
 
-func HashNs(s string, N uint16, salt []byte) []byte {
+func HashNb(bs []byte, N uint16, salt []byte) []byte {
 	h := sha256.New()
-	h.Write([]byte(s))
+	h.Write(bs)
 	h.Write(salt)
-	bs := h.Sum(nil)
+	bs = h.Sum(nil)
 	for i := uint16(1); i < N; i++ {
 		h = sha256.New()
 		h.Write(bs)
@@ -179,15 +180,16 @@ func (g *Grid) generator(seed int64) {
 
 }
 
-func generateHashedPartialKey(key string, n uint16) []byte {
+func generateHashedPartialKey(key []byte, n uint16) []byte {
 
 	salt := make([]byte, 16)
-	key1 := HashNs(key, N, salt)
+	key1 := HashNb(key, N, salt)
 	return key1
 }
-func generateSeed(key string, n uint16) int64 {
+func generateSeed(key []byte, n uint16) int64 {
 
 	key1 := generateHashedPartialKey(key, n)
+	defer secret.Wipe(key1)
 
 	reader := bytes.NewReader(key1)
 
@@ -201,7 +203,9 @@ func generateSeed(key string, n uint16) int64 {
 	// fmt.Println(hashedPartiaKey)
 	return hashedPartiaKey
 }
-func generateHashedPuzzleKey(g Grid, key string, n uint16) ([]byte, [N * N]int, string) {
+
+// the puzzle key, the puzzle and its solution as digits, which the caller wipes
+func generateHashedPuzzleKey(g Grid, key []byte, n uint16) ([]byte, [N * N]int, *secret.Secret) {
 
 	key1 := generateSeed(key, n)
 	g.generator(key1)
@@ -228,21 +232,20 @@ func generateHashedPuzzleKey(g Grid, key string, n uint16) ([]byte, [N * N]int,
 		}
 	}
 
-	var solutionStr string
+	solution1D := make([]byte, 0, N*N)
 	for _, value := range oneD {
-		solutionStr += strconv.Itoa(value) // Convert each int to a string and append
+		solution1D = strconv.AppendInt(solution1D, int64(value), 10) // Convert each int to a digit and append
 	}
-	// fmt.Println("solution:", solutionStr)
 	salt := make([]byte, 16)
-	hashedPuzzleKey := HashNs(solutionStr, n, salt)
+	hashedPuzzleKey := HashNb(solution1D, n, salt)
 	// fmt.Println("hashedPuzzleKey", hashedPuzzleKey)
-	return hashedPuzzleKey, puzzle, solutionStr
+	return hashedPuzzleKey, puzzle, secret.New(solution1D)
 
 }
 
 // check if user answer is accepted
-func validateSudoku(input string, solution string) bool {
-	return input == solution
+func validateSudoku(input []byte, solution *secret.Secret) bool {
+	return solution.Equal(input)
 }
 
 // customTheme extends the base theme provided by Fyne
@@ -268,11 +271,19 @@ func (t *customTheme) Color(name fyne.ThemeColorName, variant fyne.ThemeVariant)
 	}
 }
 
-func AcceptUserInput(initialGrid [N * N]int, solution string, resultChan chan<- bool) {
-	a := app.New()
-	w := a.NewWindow("SUDOKU PUZZLE")
-	a.Settings().SetTheme(newCustomTheme())
+func AcceptUserInput(initialGrid [N * N]int, solution *secret.Secret, resultChan chan<- bool) {
+	board.Show("SUDOKU PUZZLE", fyne.NewSize(480, 430), func(w fyne.Window, close func()) fyne.CanvasObject {
+		fyne.CurrentApp().Settings().SetTheme(newCustomTheme())
+		return sudokuGrid(w, close, initialGrid, solution, resultChan)
+	})
+	// the app is shared with the other puzzles
+	if a := fyne.CurrentApp(); a != nil {
+		a.Settings().SetTheme(theme.DefaultTheme())
+	}
+}
 
+// the grid of entries and its submit button, close hides the window
+func sudokuGrid(w fyne.Window, close func(), initialGrid [N * N]int, solution *secret.Secret, resultChan chan<- bool) fyne.CanvasObject {
 	entries := make([]*widget.Entry, N*N)
 
 	for i := range entries {
@@ -305,55 +316,52 @@ func AcceptUserInput(initialGrid [N * N]int, solution string, resultChan chan<-
 	}
 
 	submitButton := widget.NewButton("Submit", func() {
-		var result string
+		result := make([]byte, 0, N*N)
 		for _, entry := range entries {
-			result += entry.Text
+			result = append(result, entry.Text...)
 		}
 		// fmt.Println("Current Grid State:", result)
 		solved := validateSudoku(result, solution)
+		secret.Wipe(result)
 
-		resultChan <- solved
+		select {
+		case resultChan <- solved:
+		default:
+		}
 		if !solved {
 			d := dialog.NewError(errors.New("Solve failed"), w)
-			d.SetOnClosed(func() {
-				w.Close()
-			})
+			d.SetOnClosed(close)
 			d.Show()
 
 		} else {
 			info := dialog.NewInformation("Success", "Sudoku solved successfully!", w)
-			info.SetOnClosed(func() {
-				w.Close()
-				a.Quit()
-			})
+			info.SetOnClosed(close)
 			info.Show()
 		}
 
 	})
 
-	w.SetContent(container.NewVBox(
+	return container.NewVBox(
 		// grid,
 		blocks,
 		submitButton,
-	))
-
-	w.SetOnClosed(func() {
-		w.Close()
-		a.Quit()
-	})
-
-	w.Resize(fyne.NewSize(480, 430))
-	w.ShowAndRun()
+	)
 }
 
 // generate final key
-func combineTwoKeys(key string, n uint16) string {
-	HashedPartialKey := generateHashedPartialKey(key, n)
+func combineTwoKeys(key *secret.Secret, n uint16) *secret.Secret {
+	HashedPartialKey := generateHashedPartialKey(key.Bytes(), n)
 	var g Grid
-	HashedPuzzleKey, puzzle, solutionStr := generateHashedPuzzleKey(g, key, n)
+	HashedPuzzleKey, puzzle, solution := generateHashedPuzzleKey(g, key.Bytes(), n)
+	defer solution.Wipe()
 	resultChan := make(chan bool, 1)
-	AcceptUserInput(puzzle, solutionStr, resultChan)
-	solved := <-resultChan
+	AcceptUserInput(puzzle, solution, resultChan)
+	// nothing was submitted when the window was closed
+	solved := false
+	select {
+	case solved = <-resultChan:
+	default:
+	}
 	if solved {
 		fmt.Println("Sudoku solved successfully.")
 	} else {
@@ -361,13 +369,32 @@ func combineTwoKeys(key string, n uint16) string {
 		os.Exit(-2)
 	}
 
-	EncryptionKey := append(HashedPartialKey, HashedPuzzleKey...)
 	// fmt.Println("Key:", EncryptionKey)
-	return string(EncryptionKey)
+	return joinKeys(HashedPartialKey, HashedPuzzleKey)
+}
+
+// the final key from both halves, which are wiped
+func joinKeys(partial []byte, puzzle []byte) *secret.Secret {
+	EncryptionKey := make([]byte, 0, len(partial)+len(puzzle))
+	EncryptionKey = append(EncryptionKey, partial...)
+	EncryptionKey = append(EncryptionKey, puzzle...)
+	secret.Wipe(partial)
+	secret.Wipe(puzzle)
+	return secret.New(EncryptionKey)
+}
+
+// compute the final key without asking the user to solve the puzzle
+// used when the key is wrapped for someone else who solves the puzzle later
+func SolvePuzzleKey(key *secret.Secret, n uint16) *secret.Secret {
+	HashedPartialKey := generateHashedPartialKey(key.Bytes(), n)
+	var g Grid
+	HashedPuzzleKey, _, solution := generateHashedPuzzleKey(g, key.Bytes(), n)
+	solution.Wipe()
+	return joinKeys(HashedPartialKey, HashedPuzzleKey)
 }
 
 // main
-func GetPuzzleKey(key string, n uint16) string {
+func GetPuzzleKey(key *secret.Secret, n uint16) *secret.Secret {
 
 	return combineTwoKeys(key, n)
 }
@@ -0,0 +1,263 @@
+package zipenc
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// archive formats, the format used is recorded in the header
+const (
+	// a zip archive, entries are compressed one by one (the default)
+	FormatZip = "zip"
+	// a tar stream, compressed as a whole, keeps unix owners and extended attributes
+	FormatTar = "tar"
+	// a single file without any archive, decrypts back to a file
+	FormatRaw = "raw"
+	// every file is compressed and encrypted on its own behind an encrypted
+	// index, so single entries can be listed and extracted
+	FormatEntries = "entries"
+)
+
+// compression methods
+// zip entries are deflated and the streams of the other formats are gzip (deflate
+// with a header and checksum), each name is taken for the other for the format
+// files written before CompressGzip was named record their gzip streams as CompressDeflate
+const (
+	CompressNone    = "none"
+	CompressDeflate = "deflate"
+	CompressGzip    = "gzip"
+	CompressZstd    = "zstd"
+	CompressXz      = "xz"
+)
+
+// zip method ids of the compressions archive/zip doesn't know (APPNOTE 4.4.5)
+const (
+	zipMethodZstd = 93
+	zipMethodXz   = 95
+)
+
+// how the input is packed before it is encrypted
+type ArchiveOptions struct {
+	// FormatZip (default), FormatTar or FormatRaw
+	Format string
+	// CompressDeflate for zip or CompressGzip otherwise (default), CompressNone, CompressZstd or CompressXz
+	Compression string
+	// the redundancy in percent of the Reed-Solomon parity appended to the file, 0 for none
+	Parity int
+}
+
+// file types that are already compressed and are stored as is
+var compressedExt = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+	".7z": true, ".rar": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".webp": true, ".heic": true, ".mp3": true, ".ogg": true, ".flac": true, ".mp4": true,
+	".mkv": true, ".avi": true, ".mov": true, ".webm": true, ".docx": true, ".xlsx": true,
+	".pptx": true, ".jar": true, ".apk": true,
+}
+
+// whether a file is already compressed judging by its name
+func isCompressed(name string) bool {
+	return compressedExt[strings.ToLower(filepath.Ext(name))]
+}
+
+// fill in the defaults and reject unknown formats and compressions
+func (o ArchiveOptions) normalize() (ArchiveOptions, error) {
+	if o.Format == "" {
+		o.Format = FormatZip
+	}
+	switch o.Format {
+	case FormatZip, FormatTar, FormatRaw, FormatEntries:
+	default:
+		return o, fmt.Errorf("unknown archive format %q", o.Format)
+	}
+	switch o.Compression {
+	case "", CompressDeflate, CompressGzip:
+		o.Compression = CompressGzip
+		if o.Format == FormatZip {
+			o.Compression = CompressDeflate
+		}
+	case CompressNone, CompressZstd, CompressXz:
+	default:
+		return o, fmt.Errorf("unknown compression %q", o.Compression)
+	}
+	if o.Parity < 0 || o.Parity > 100 {
+		return o, fmt.Errorf("parity redundancy %d%% is not between 0 and 100", o.Parity)
+	}
+	return o, nil
+}
+
+// a WriteCloser that doesn't close the underlying writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// wrap w so everything written to it is compressed
+// closing the returned writer flushes the compressor but not w
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressNone:
+		return nopWriteCloser{w}, nil
+	case CompressGzip:
+		return gzip.NewWriterLevel(w, flate.DefaultCompression)
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	case CompressXz:
+		return xz.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
+
+// a compressor created on first use
+// archive/zip creates compressors before it writes the entry header, so a
+// compressor that writes its stream header straight away (xz) has to wait
+type lazyWriter struct {
+	w           io.Writer
+	compression string
+	cw          io.WriteCloser
+}
+
+func (l *lazyWriter) init() (err error) {
+	if l.cw == nil {
+		l.cw, err = compressWriter(l.w, l.compression)
+	}
+	return err
+}
+
+func (l *lazyWriter) Write(p []byte) (int, error) {
+	if err := l.init(); err != nil {
+		return 0, err
+	}
+	return l.cw.Write(p)
+}
+
+func (l *lazyWriter) Close() error {
+	if err := l.init(); err != nil {
+		return err
+	}
+	return l.cw.Close()
+}
+
+// wrap r so reads return the decompressed stream
+func decompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressNone:
+		return io.NopCloser(r), nil
+	case CompressGzip, CompressDeflate:
+		return gzip.NewReader(r)
+	case CompressZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case CompressXz:
+		x, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(x), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
+
+// pack infile (a file or folder) into w
+func pack(infile string, w io.Writer, opts ArchiveOptions) error {
+	switch opts.Format {
+	case FormatZip:
+		return zipFile(infile, w, opts.Compression)
+	case FormatTar:
+		return tarFile(infile, w, opts.Compression)
+	case FormatRaw:
+		return rawFile(infile, w, opts.Compression)
+	}
+	return fmt.Errorf("unknown archive format %q", opts.Format)
+}
+
+// unpack the archive held in data into outfile (a folder, or a file for FormatRaw)
+// only the entries at or below paths are unpacked, every entry when paths is empty
+// nothing is written to outfile unless the whole archive unpacks
+func unpack(data []byte, outfile string, opts ArchiveOptions, paths []string) error {
+	size := int64(len(data))
+	switch opts.Format {
+	case FormatZip:
+		return extractAtomically(outfile, func(tmp string) error { return unzipFile(bytes.NewReader(data), size, tmp, paths) })
+	case FormatTar:
+		return extractAtomically(outfile, func(tmp string) error {
+			return untarFile(bytes.NewReader(data), size, tmp, opts.Compression, paths)
+		})
+	case FormatRaw:
+		if len(paths) > 0 {
+			return fmt.Errorf("the file holds a single raw file, there are no paths to extract")
+		}
+		return extractFileAtomically(outfile, func(tmp string) error {
+			return unrawFile(bytes.NewReader(data), size, tmp, opts.Compression)
+		})
+	}
+	return fmt.Errorf("unknown archive format %q", opts.Format)
+}
+
+// compress a single regular file without an archive around it
+func rawFile(infile string, w io.Writer, compression string) error {
+	info, err := os.Stat(infile)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("the raw format needs a single regular file, %s is not one", infile)
+	}
+	f, err := os.Open(infile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cw, err := compressWriter(w, compression)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(cw, f)
+	if err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// decompress a raw single file of the given size read from in into outfile,
+// within the size limits of ExtractionPolicy
+func unrawFile(in io.Reader, size int64, outfile string, compression string) error {
+	r, err := decompressReader(in, compression)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	e := newExtraction(filepath.Dir(outfile))
+	if compression != CompressNone {
+		e.stream = size
+	}
+
+	out, err := os.OpenFile(outfile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = e.copy(out, r, filepath.Base(outfile), 0)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
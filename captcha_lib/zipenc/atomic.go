@@ -0,0 +1,70 @@
+package zipenc
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// write data to file through a temporary file in the same folder
+// the data is synced before the rename so a crash leaves either the old file or the new one
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	return writeAtomic(file, perm, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+// write data to file the way writeFileAtomic does, for callers outside the package
+func WriteFileAtomic(file string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(file, data, perm)
+}
+
+// create file from whatever write produces, the temporary file is removed on any error
+// write may read back what it wrote through the file
+func writeAtomic(file string, perm os.FileMode, write func(f *os.File) error) (err error) {
+	dir := filepath.Dir(file)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(file)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	err = f.Chmod(perm)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), file)
+	if err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// flush a folder so a rename inside it survives a crash
+// not every platform can sync a folder, so this is best effort
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
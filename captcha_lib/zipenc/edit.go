@@ -0,0 +1,367 @@
+package zipenc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"captcha/captcha_lib/secret"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/***
+
+editing an encrypted archive in place
+
+the file is unlocked once, the archive is decrypted into memory and
+entries are added or removed there. saving seals the new archive under
+the same data key with a fresh nonce, so every key slot keeps working and
+no plaintext is written to disk
+
+archives encrypted entry by entry (FormatEntries) only decrypt their index.
+saving copies the kept entries as they are and encrypts added files from
+disk, so they have to stay in place until the archive is saved
+
+***/
+
+// an entry of an encrypted archive
+type Entry struct {
+	Name     string
+	Size     int64
+	Mode     os.FileMode
+	Modified time.Time
+}
+
+// an encrypted archive opened for editing
+// the data key and the decrypted archive are held in memory until Close
+type Archive struct {
+	file   string
+	header ContextHeaderStruct
+	opts   ArchiveOptions
+	key    *secret.Secret
+	data   []byte
+	// the index of a FormatEntries archive, data is unused
+	entries []indexEntry
+	changed bool
+}
+
+// unlock file and decrypt its archive for editing
+func OpenArchive(unlock Unlock, file string) (*Archive, error) {
+	header, _, err := readHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	if header.Format == FormatEntries {
+		ef, err := openEntries(unlock, file)
+		if err != nil {
+			return nil, err
+		}
+		ef.f.Close()
+		return &Archive{file: file, header: ef.header, opts: header.archive(), key: ef.key, entries: ef.entries}, nil
+	}
+
+	header, payload, err := readContainer(file)
+	if err != nil {
+		return nil, err
+	}
+	opts := header.archive()
+	if opts.Format == FormatRaw {
+		return nil, fmt.Errorf("%s holds a single raw file, only zip and tar archives can be edited", file)
+	}
+	key, err := unlockKey(unlock, header)
+	if err != nil {
+		return nil, fmt.Errorf("unlock: %w", err)
+	}
+	data, err := open(key.Bytes(), payload)
+	if err != nil {
+		key.Wipe()
+		return nil, fmt.Errorf("decrypt file: %v", err)
+	}
+	return &Archive{file: file, header: header, opts: opts, key: key, data: data}, nil
+}
+
+// whether there are changes that are not saved yet
+func (a *Archive) Changed() bool {
+	return a.changed
+}
+
+// list the entries of the archive
+func (a *Archive) Entries() ([]Entry, error) {
+	var entries []Entry
+	if a.opts.Format == FormatEntries {
+		for _, x := range a.entries {
+			entries = append(entries, Entry{Name: x.Name, Size: x.Size, Mode: x.Mode, Modified: x.Modified})
+		}
+		return entries, nil
+	}
+	err := a.walk(func(name string, info os.FileInfo) {
+		entries = append(entries, Entry{Name: name, Size: info.Size(), Mode: info.Mode(), Modified: info.ModTime()})
+	})
+	return entries, err
+}
+
+// visit every entry in archive order
+func (a *Archive) walk(visit func(name string, info os.FileInfo)) error {
+	switch a.opts.Format {
+	case FormatZip:
+		r, err := zip.NewReader(bytes.NewReader(a.data), int64(len(a.data)))
+		if err != nil {
+			return err
+		}
+		for _, f := range r.File {
+			visit(f.Name, f.FileInfo())
+		}
+		return nil
+	case FormatTar:
+		rc, err := decompressReader(bytes.NewReader(a.data), a.opts.Compression)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		reader := tar.NewReader(rc)
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			visit(header.Name, header.FileInfo())
+		}
+	}
+	return fmt.Errorf("unknown archive format %q", a.opts.Format)
+}
+
+// whether the entry name lies at or below target (a file or folder name)
+func under(name string, target string) bool {
+	name = strings.TrimSuffix(name, "/")
+	return name == target || strings.HasPrefix(name, target+"/")
+}
+
+// clean an archive path given by the user
+func cleanName(name string) string {
+	return strings.Trim(filepath.ToSlash(filepath.Clean(name)), "/")
+}
+
+// add infile (a file or folder) below the archive folder dir ("" for the top)
+// entries with the same names are replaced, the replaced names are returned
+func (a *Archive) Add(infile string, dir string) ([]string, error) {
+	dir = cleanName(dir)
+	if dir == "." {
+		dir = ""
+	}
+	// the names infile adds
+	names := make(map[string]bool)
+	err := filepath.Walk(infile, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := entryName(infile, path, dir, info.IsDir())
+		names[name] = true
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var replaced []string
+	keep := func(name string) bool {
+		if names[name] {
+			replaced = append(replaced, name)
+			return false
+		}
+		return true
+	}
+	return replaced, a.rebuild(keep, infile, dir)
+}
+
+// remove the entry name, a folder is removed with everything inside it
+// returns the number of entries removed
+func (a *Archive) Remove(name string) (int, error) {
+	target := cleanName(name)
+	removed := 0
+	keep := func(entry string) bool {
+		if under(entry, target) {
+			removed++
+			return false
+		}
+		return true
+	}
+	err := a.rebuild(keep, "", "")
+	if err != nil {
+		return 0, err
+	}
+	if removed == 0 {
+		return 0, fmt.Errorf("no entry %s in the archive", name)
+	}
+	return removed, nil
+}
+
+// write a new archive holding the entries keep accepts followed by infile (when set)
+func (a *Archive) rebuild(keep func(name string) bool, infile string, dir string) error {
+	if a.opts.Format == FormatEntries {
+		return a.rebuildEntries(keep, infile, dir)
+	}
+	var buf bytes.Buffer
+	var err error
+	switch a.opts.Format {
+	case FormatZip:
+		err = a.rebuildZip(&buf, keep, infile, dir)
+	case FormatTar:
+		err = a.rebuildTar(&buf, keep, infile, dir)
+	default:
+		err = fmt.Errorf("unknown archive format %q", a.opts.Format)
+	}
+	if err != nil {
+		secret.Wipe(buf.Bytes())
+		return err
+	}
+	secret.Wipe(a.data)
+	a.data = buf.Bytes()
+	a.changed = true
+	return nil
+}
+
+// drop the entries keep refuses from the index and index infile
+// the files of infile are encrypted when the archive is saved
+func (a *Archive) rebuildEntries(keep func(name string) bool, infile string, dir string) error {
+	var entries []indexEntry
+	for _, x := range a.entries {
+		if keep(x.Name) {
+			entries = append(entries, x)
+		}
+	}
+	if infile != "" {
+		added, err := indexFiles(infile, dir, a.opts.Compression)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, added...)
+	}
+	a.entries = entries
+	a.changed = true
+	return nil
+}
+
+// copy the kept zip entries as they are (still compressed) and append infile
+func (a *Archive) rebuildZip(w io.Writer, keep func(name string) bool, infile string, dir string) error {
+	r, err := zip.NewReader(bytes.NewReader(a.data), int64(len(a.data)))
+	if err != nil {
+		return err
+	}
+	writer := newZipWriter(w)
+	for _, f := range r.File {
+		if !keep(f.Name) {
+			continue
+		}
+		err = writer.Copy(f)
+		if err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	if infile != "" {
+		err = zipAdd(writer, infile, dir, a.opts.Compression)
+		if err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// rewrite the tar stream with the kept entries and append infile
+func (a *Archive) rebuildTar(w io.Writer, keep func(name string) bool, infile string, dir string) error {
+	rc, err := decompressReader(bytes.NewReader(a.data), a.opts.Compression)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	reader := tar.NewReader(rc)
+
+	cw, err := compressWriter(w, a.opts.Compression)
+	if err != nil {
+		return err
+	}
+	writer := tar.NewWriter(cw)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !keep(header.Name) {
+			continue
+		}
+		err = writer.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, reader)
+		if err != nil {
+			return err
+		}
+	}
+	if infile != "" {
+		err = tarAdd(writer, infile, dir)
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// encrypt the edited archive back into the file
+// the header and key slots are kept, only the payload changes
+func (a *Archive) Save() error {
+	if !a.changed {
+		return nil
+	}
+	if a.opts.Format == FormatEntries {
+		return a.saveEntries()
+	}
+	payload, err := seal(a.key.Bytes(), a.data)
+	if err != nil {
+		return fmt.Errorf("encrypt: %v", err)
+	}
+	err = writeContainer(a.file, a.header, payload)
+	if err != nil {
+		return err
+	}
+	a.changed = false
+	return nil
+}
+
+// write the index and the added entries, kept entries are copied from the file as they are
+func (a *Archive) saveEntries() error {
+	f, _, payload, err := openPayload(a.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := writeEntries(a.file, a.header, a.key, a.entries, payload)
+	if err != nil {
+		return err
+	}
+	a.entries = entries
+	a.changed = false
+	return nil
+}
+
+// wipe the data key and the decrypted archive, unsaved changes are lost
+func (a *Archive) Close() {
+	a.key.Wipe()
+	secret.Wipe(a.data)
+	a.data = nil
+}
@@ -0,0 +1,713 @@
+package zipenc
+
+import (
+	"bytes"
+	"captcha/captcha_lib/secret"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/***
+
+per-entry encryption (FormatEntries)
+
+every file is compressed and encrypted on its own under a key derived from
+the data key and a random entry id. an encrypted index names the entries
+and records where their ciphertext lies, so listing decrypts only the index
+and extracting a path decrypts only the entries below it
+
+the payload after the header is laid out as
+
+	entry ciphertexts | sealed index | length of the sealed index (8 bytes, big endian)
+
+the ciphertext of an entry is a run of sealed chunks of at most entryChunk
+bytes of compressed content. every chunk is bound to its entry, its position
+and whether it is the last one, so chunks can't be dropped, reordered or
+swapped between entries without the decryption failing
+
+***/
+
+// the most compressed bytes sealed in one chunk
+const entryChunk = 1 << 20
+
+// an entry of the encrypted index
+type indexEntry struct {
+	Name     string            `json:"Name"`
+	Mode     os.FileMode       `json:"Mode"`
+	Modified time.Time         `json:"Modified"`
+	Size     int64             `json:"Size"`
+	Link     string            `json:"Link,omitempty"`
+	HasOwner bool              `json:"HasOwner,omitempty"`
+	Uid      int               `json:"Uid,omitempty"`
+	Gid      int               `json:"Gid,omitempty"`
+	Xattrs   map[string][]byte `json:"Xattrs,omitempty"`
+	// how the content is compressed, regular files only
+	Compression string `json:"Compression,omitempty"`
+	// the random id the entry key is derived from
+	ID []byte `json:"ID,omitempty"`
+	// where the ciphertext lies, relative to the start of the payload
+	Offset int64 `json:"Offset"`
+	Length int64 `json:"Length,omitempty"`
+	Chunks int   `json:"Chunks,omitempty"`
+
+	// the file on disk a new entry is encrypted from when the index is written
+	source string
+}
+
+// the plaintext of the sealed index
+type entryIndex struct {
+	Entries []indexEntry `json:"Entries"`
+}
+
+// the metadata restored after extraction
+func (x indexEntry) meta() entryMeta {
+	return entryMeta{Mode: x.Mode, Modified: x.Modified, HasOwner: x.HasOwner, Uid: x.Uid, Gid: x.Gid, Xattrs: x.Xattrs}
+}
+
+// the key sealing the index
+func indexKey(key *secret.Secret) *secret.Secret {
+	return secret.New(hkdfKey(key.Bytes(), nil, "captcha-index"))
+}
+
+// the cipher sealing the chunks of the entry with the given id
+func entryCipher(key *secret.Secret, id []byte) (cipher.AEAD, error) {
+	k := secret.New(hkdfKey(key.Bytes(), id, "captcha-entry"))
+	defer k.Wipe()
+	return newGCM(k.Bytes())
+}
+
+// the additional data binding a chunk to its entry and position
+func chunkData(id []byte, chunk int, last bool) []byte {
+	data := binary.BigEndian.AppendUint64(append([]byte(nil), id...), uint64(chunk))
+	if last {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// seals everything written to it in chunks of entryChunk bytes
+// Close seals the last chunk, an empty entry still has one
+type chunkWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	id      []byte
+	buf     []byte
+	chunks  int
+	written int64
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data shows it isn't the last
+		if len(c.buf) == entryChunk {
+			if err := c.flush(false); err != nil {
+				return 0, err
+			}
+		}
+		if c.buf == nil {
+			c.buf = make([]byte, 0, entryChunk)
+		}
+		k := min(entryChunk-len(c.buf), len(p))
+		c.buf = append(c.buf, p[:k]...)
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (c *chunkWriter) Close() error {
+	err := c.flush(true)
+	c.buf = nil
+	return err
+}
+
+func (c *chunkWriter) flush(last bool) error {
+	nonce := make([]byte, c.gcm.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	sealed := c.gcm.Seal(nonce, nonce, c.buf, chunkData(c.id, c.chunks, last))
+	secret.Wipe(c.buf)
+	c.buf = c.buf[:0]
+	n, err := c.w.Write(sealed)
+	c.written += int64(n)
+	c.chunks++
+	return err
+}
+
+// opens the chunks sealed by a chunkWriter, Close wipes what is left in memory
+type chunkReader struct {
+	r         io.Reader
+	gcm       cipher.AEAD
+	id        []byte
+	name      string
+	chunks    int
+	next      int
+	remaining int64
+	plain     []byte
+	buf       []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.next == c.chunks {
+			return 0, io.EOF
+		}
+		if err := c.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkReader) open() error {
+	last := c.next == c.chunks-1
+	overhead := int64(c.gcm.NonceSize() + c.gcm.Overhead())
+	size := entryChunk + overhead
+	if last {
+		size = c.remaining
+	}
+	if size > c.remaining || size < overhead {
+		return fmt.Errorf("entry %s: %w", c.name, ErrTruncated)
+	}
+	sealed := make([]byte, size)
+	_, err := io.ReadFull(c.r, sealed)
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("entry %s: %w", c.name, ErrTruncated)
+	}
+	if err != nil {
+		return fmt.Errorf("entry %s: %v", c.name, err)
+	}
+	c.remaining -= size
+
+	nonce := sealed[:c.gcm.NonceSize()]
+	// decrypt in place so only one copy of the chunk exists
+	plain, err := c.gcm.Open(sealed[len(nonce):len(nonce)], nonce, sealed[len(nonce):], chunkData(c.id, c.next, last))
+	if err != nil {
+		return fmt.Errorf("decrypt entry %s: %w", c.name, ErrTampered)
+	}
+	secret.Wipe(c.plain)
+	c.plain = plain
+	c.buf = plain
+	c.next++
+	return nil
+}
+
+func (c *chunkReader) Close() error {
+	secret.Wipe(c.plain)
+	c.plain, c.buf = nil, nil
+	return nil
+}
+
+// a writer that seals the content of entry x into w under a new entry id
+// the id, length and chunk count of x are filled in on Close
+type entryWriter struct {
+	*chunkWriter
+	x *indexEntry
+}
+
+func newEntryWriter(w io.Writer, key *secret.Secret, x *indexEntry) (*entryWriter, error) {
+	id := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := entryCipher(key, id)
+	if err != nil {
+		return nil, err
+	}
+	return &entryWriter{&chunkWriter{w: w, gcm: gcm, id: id}, x}, nil
+}
+
+func (ew *entryWriter) Close() error {
+	err := ew.chunkWriter.Close()
+	ew.x.ID = ew.id
+	ew.x.Length = ew.written
+	ew.x.Chunks = ew.chunks
+	return err
+}
+
+// a reader of the compressed content of entry x, the payload is read from r
+func newEntryReader(r io.ReaderAt, key *secret.Secret, x indexEntry) (*chunkReader, error) {
+	gcm, err := entryCipher(key, x.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{
+		r:         io.NewSectionReader(r, x.Offset, x.Length),
+		gcm:       gcm,
+		id:        x.ID,
+		name:      x.Name,
+		chunks:    x.Chunks,
+		remaining: x.Length,
+	}, nil
+}
+
+// the index entries of infile (a file or folder), named below the archive folder prefix ("" for the top)
+// regular files are encrypted from their source when the index is written
+func indexFiles(infile string, prefix string, compression string) ([]indexEntry, error) {
+	var entries []indexEntry
+	// Walk uses Lstat so symlinks are visited as links and not followed
+	err := filepath.Walk(infile, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := entryName(infile, path, prefix, info.IsDir())
+		if err != nil {
+			return err
+		}
+		x := indexEntry{Name: name, Mode: info.Mode(), Modified: info.ModTime()}
+		switch {
+		case info.IsDir():
+		case info.Mode()&os.ModeSymlink != 0:
+			x.Link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			x.Size = info.Size()
+			x.source = path
+			// already compressed files are stored as is
+			x.Compression = compression
+			if isCompressed(info.Name()) {
+				x.Compression = CompressNone
+			}
+		default:
+			return fmt.Errorf("unsupported file type %s", path)
+		}
+
+		if PreserveOwner {
+			x.Uid, x.Gid, x.HasOwner = fileOwner(info)
+		}
+		if PreserveXattrs {
+			attrs, err := listXattrs(path)
+			if err == nil && len(attrs) > 0 {
+				x.Xattrs = attrs
+			}
+		}
+		entries = append(entries, x)
+		return nil
+	})
+	return entries, err
+}
+
+// compress and encrypt the source of x into w
+func writeEntry(w io.Writer, key *secret.Secret, x *indexEntry) error {
+	f, err := os.Open(x.source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ew, err := newEntryWriter(w, key, x)
+	if err != nil {
+		return err
+	}
+	cw, err := compressWriter(ew, x.Compression)
+	if err != nil {
+		return err
+	}
+	// the size is taken from what is read, the file may have changed since the walk
+	x.Size, err = io.Copy(cw, f)
+	if err != nil {
+		return err
+	}
+	err = cw.Close()
+	if err != nil {
+		return err
+	}
+	err = ew.Close()
+	if err != nil {
+		return err
+	}
+	x.source = ""
+	return nil
+}
+
+// seal the index under key and append it with its length
+func writeIndex(w io.Writer, key *secret.Secret, entries []indexEntry) error {
+	plain, err := json.Marshal(entryIndex{Entries: entries})
+	if err != nil {
+		return err
+	}
+	defer secret.Wipe(plain)
+	k := indexKey(key)
+	defer k.Wipe()
+	sealed, err := seal(k.Bytes(), plain)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(binary.BigEndian.AppendUint64(nil, uint64(len(sealed))))
+	return err
+}
+
+// decrypt the index of a payload of the given size read from r
+// every entry is checked to lie within the payload
+func readIndex(r io.ReaderAt, size int64, key *secret.Secret) ([]indexEntry, error) {
+	if size < 8 {
+		return nil, fmt.Errorf("index: %w", ErrTruncated)
+	}
+	trailer := make([]byte, 8)
+	_, err := r.ReadAt(trailer, size-8)
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint64(trailer)
+	if n > uint64(size-8) {
+		return nil, fmt.Errorf("index: %w", ErrTruncated)
+	}
+	end := size - 8 - int64(n)
+	sealed := make([]byte, n)
+	_, err = r.ReadAt(sealed, end)
+	if err != nil {
+		return nil, err
+	}
+
+	k := indexKey(key)
+	defer k.Wipe()
+	plain, err := open(k.Bytes(), sealed)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt index: %w", ErrTampered)
+	}
+	defer secret.Wipe(plain)
+	var index entryIndex
+	err = json.Unmarshal(plain, &index)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalling index: %v (%w)", err, ErrCorrupt)
+	}
+
+	for _, x := range index.Entries {
+		if x.Offset < 0 || x.Length < 0 || x.Offset+x.Length > end {
+			return nil, fmt.Errorf("entry %s lies outside of the file (%w)", x.Name, ErrCorrupt)
+		}
+		if x.Mode.IsRegular() && (x.Chunks < 1 || len(x.ID) == 0) {
+			return nil, fmt.Errorf("entry %s has no content (%w)", x.Name, ErrCorrupt)
+		}
+	}
+	return index.Entries, nil
+}
+
+// write a FormatEntries file: the header, the entry ciphertexts and the sealed index
+// entries with a source are encrypted from disk, the others are copied as
+// they are from old, the payload of the previous version of the file
+// returns the entries with their new offsets
+func writeEntries(file string, header ContextHeaderStruct, key *secret.Secret, entries []indexEntry, old io.ReaderAt) ([]indexEntry, error) {
+	headerB, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling header: %v", err)
+	}
+	// work on a copy so the caller's entries stay valid when writing fails
+	entries = append([]indexEntry(nil), entries...)
+	err = writeAtomic(file, 0644, func(w *os.File) error {
+		_, err := w.Write(headerB)
+		if err != nil {
+			return err
+		}
+		var offset int64
+		for i := range entries {
+			x := &entries[i]
+			switch {
+			case x.source != "":
+				err = writeEntry(w, key, x)
+				if err != nil {
+					return fmt.Errorf("%s: %v", x.source, err)
+				}
+			case x.Length > 0:
+				n, err := io.Copy(w, io.NewSectionReader(old, x.Offset, x.Length))
+				if err == nil && n < x.Length {
+					err = io.ErrUnexpectedEOF
+				}
+				if err != nil {
+					return fmt.Errorf("copying entry %s: %v", x.Name, err)
+				}
+			}
+			x.Offset = offset
+			offset += x.Length
+		}
+		err = writeIndex(w, key, entries)
+		if err != nil {
+			return err
+		}
+		return appendParity(w, header.Parity)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// pack infile as a FormatEntries file and encrypt it so that any one of the slots can open it
+func encryptEntries(specs []SlotSpec, N uint16, opts ArchiveOptions, infile string, outfile string) error {
+	entries, err := indexFiles(infile, "", opts.Compression)
+	if err != nil {
+		return fmt.Errorf("packing %s: %v", infile, err)
+	}
+	key, header, err := newContainer(specs, N, opts)
+	if err != nil {
+		return err
+	}
+	defer key.Wipe()
+	_, err = writeEntries(outfile, header, key, entries, nil)
+	return err
+}
+
+// re-encrypt the entries and index of a FormatEntries payload from key under newKey
+// the compressed content is moved over chunk by chunk and never decompressed
+func resealEntries(payload []byte, key *secret.Secret, newKey *secret.Secret) ([]byte, error) {
+	r := bytes.NewReader(payload)
+	entries, err := readIndex(r, int64(len(payload)), key)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for i := range entries {
+		x := &entries[i]
+		offset := int64(buf.Len())
+		if x.Length > 0 {
+			cr, err := newEntryReader(r, key, *x)
+			if err != nil {
+				return nil, err
+			}
+			ew, err := newEntryWriter(&buf, newKey, x)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(ew, cr)
+			cr.Close()
+			if err == nil {
+				err = ew.Close()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		x.Offset = offset
+	}
+	err = writeIndex(&buf, newKey, entries)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// a FormatEntries file opened for reading, only its index is decrypted
+type entryFile struct {
+	// the file the payload is read from, nil when the container is held in memory
+	f       *os.File
+	payload *io.SectionReader
+	header  ContextHeaderStruct
+	key     *secret.Secret
+	entries []indexEntry
+}
+
+// open the payload of file for reading
+func openPayload(file string) (*os.File, ContextHeaderStruct, *io.SectionReader, error) {
+	var header ContextHeaderStruct
+	if err := manifestError(file); err != nil {
+		return nil, header, nil, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, header, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, header, nil, err
+	}
+	header, payload, err := payloadSection(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, header, nil, err
+	}
+	return f, header, payload, nil
+}
+
+// the header of the container of size bytes read from r and the section of r holding its payload
+func payloadSection(r io.ReaderAt, size int64) (ContextHeaderStruct, *io.SectionReader, error) {
+	header, base, err := decodeHeader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return header, nil, err
+	}
+	return header, io.NewSectionReader(r, base, containerSize(r, size)-base), nil
+}
+
+// unlock a FormatEntries file and decrypt its index
+func openEntries(unlock Unlock, file string) (*entryFile, error) {
+	f, header, payload, err := openPayload(file)
+	if err != nil {
+		return nil, err
+	}
+	if header.Format != FormatEntries {
+		f.Close()
+		return nil, fmt.Errorf("%s is not encrypted entry by entry", file)
+	}
+	ef, err := unlockEntries(unlock, header, payload)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ef.f = f
+	return ef, nil
+}
+
+// unlock the FormatEntries container with header and decrypt the index in its payload
+func unlockEntries(unlock Unlock, header ContextHeaderStruct, payload *io.SectionReader) (*entryFile, error) {
+	key, err := unlockKey(unlock, header)
+	if err != nil {
+		return nil, fmt.Errorf("unlock: %w", err)
+	}
+	entries, err := readIndex(payload, payload.Size(), key)
+	if err != nil {
+		key.Wipe()
+		return nil, err
+	}
+	return &entryFile{payload: payload, header: header, key: key, entries: entries}, nil
+}
+
+// close the file and wipe the data key
+func (ef *entryFile) Close() {
+	if ef.f != nil {
+		ef.f.Close()
+	}
+	ef.key.Wipe()
+}
+
+// a reader of the decompressed content of entry x
+func (ef *entryFile) open(x indexEntry) (io.ReadCloser, error) {
+	cr, err := newEntryReader(ef.payload, ef.key, x)
+	if err != nil {
+		return nil, err
+	}
+	// the chunk errors already name the entry
+	rc, err := decompressReader(cr, x.Compression)
+	if err != nil {
+		cr.Close()
+		return nil, err
+	}
+	return entryReadCloser{rc, cr}, nil
+}
+
+// closes the decompressor and then wipes the chunks under it
+type entryReadCloser struct {
+	io.ReadCloser
+	chunks *chunkReader
+}
+
+func (r entryReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.chunks.Close()
+	return err
+}
+
+// extract the entries at or below paths (every entry when paths is empty) into the folder outfile
+// only the selected entries are decrypted, they are checked against ExtractionPolicy
+func (ef *entryFile) extract(outfile string, paths []string) error {
+	return extractAtomically(outfile, func(tmp string) error {
+		e := newExtraction(tmp)
+		e.choose(paths)
+
+		// directories get their permissions and times once everything inside them is written
+		type dirEntry struct {
+			path string
+			meta entryMeta
+		}
+		var dirs []dirEntry
+
+		for _, x := range ef.entries {
+			if !e.wanted(x.Name) {
+				continue
+			}
+			path, err := e.entry(x.Name)
+			if err != nil {
+				return err
+			}
+			if x.Mode.IsDir() {
+				err = os.MkdirAll(path, 0755)
+				if err != nil {
+					return err
+				}
+				dirs = append(dirs, dirEntry{path, x.meta()})
+				continue
+			}
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				return err
+			}
+			if x.Mode&os.ModeSymlink != 0 {
+				err = extractSymlink(e, strings.NewReader(x.Link), x.Name, path, x.meta())
+			} else {
+				err = ef.extractFile(e, x, path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := e.missing(); err != nil {
+			return err
+		}
+
+		// deepest directories first so restoring a child doesn't change its parent again
+		for i := len(dirs) - 1; i >= 0; i-- {
+			err := restoreMetadata(dirs[i].path, dirs[i].meta)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// decrypt the regular file x to path
+func (ef *entryFile) extractFile(e *extraction, x indexEntry, path string) error {
+	rc, err := ef.open(x)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// O_EXCL as every entry goes to a fresh folder
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, x.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	err = e.copy(out, rc, x.Name, x.Length)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return restoreMetadata(path, x.meta())
+}
+
+// list the entries of an encrypted archive
+// FormatEntries files only decrypt their index, other archives are decrypted whole
+func ListEntries(unlock Unlock, file string) ([]Entry, error) {
+	a, err := OpenArchive(unlock, file)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.Entries()
+}
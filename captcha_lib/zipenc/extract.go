@@ -0,0 +1,407 @@
+package zipenc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// what to do with symlinks found in an archive
+const (
+	// restore links only when their target stays inside the output folder
+	SymlinksConfine = "confine"
+	// refuse archives holding any symlink
+	SymlinksRefuse = "refuse"
+)
+
+// what to do when an extracted file already exists
+const (
+	OverwriteNever  = "never"
+	OverwriteAsk    = "ask"
+	OverwriteAlways = "always"
+)
+
+// limits and rules applied when extracting an archive
+type ExtractPolicy struct {
+	// the most bytes all entries together may expand to
+	MaxTotalSize int64
+	// the most entries an archive may hold
+	MaxEntries int
+	// the largest expansion ratio of a compressed entry (uncompressed / compressed)
+	MaxRatio float64
+	// SymlinksConfine or SymlinksRefuse
+	Symlinks string
+	// OverwriteNever, OverwriteAsk or OverwriteAlways
+	Overwrite string
+}
+
+// the policy used unless configured otherwise
+var DefaultExtractPolicy = ExtractPolicy{
+	MaxTotalSize: 16 << 30,
+	MaxEntries:   100000,
+	MaxRatio:     1000,
+	Symlinks:     SymlinksConfine,
+	Overwrite:    OverwriteNever,
+}
+
+// the policy extraction follows, it can be replaced by callers
+var ExtractionPolicy = DefaultExtractPolicy
+
+// the state of one extraction checked against ExtractionPolicy
+type extraction struct {
+	policy  ExtractPolicy
+	root    string
+	entries int
+	total   int64
+	// the compressed size of a whole stream archive (tar, raw), 0 when entries are compressed one by one
+	stream int64
+	seen   map[string]bool
+	// the archive paths to extract, every entry when empty
+	only    []string
+	matched map[string]bool
+	// the paths the targets of the symlinks extracted so far go through, a link there would redirect them
+	through map[string]bool
+}
+
+// the most symlinks followed resolving the target of one
+const maxLinkHops = 40
+
+func newExtraction(root string) *extraction {
+	return &extraction{policy: ExtractionPolicy, root: filepath.Clean(root), seen: make(map[string]bool), through: make(map[string]bool)}
+}
+
+// extract only the entries at or below paths, every entry when paths is empty
+func (e *extraction) choose(paths []string) {
+	e.only = nil
+	for _, p := range paths {
+		e.only = append(e.only, cleanName(p))
+	}
+	e.matched = make(map[string]bool)
+}
+
+// whether the entry name is extracted
+func (e *extraction) wanted(name string) bool {
+	if len(e.only) == 0 {
+		return true
+	}
+	found := false
+	for _, p := range e.only {
+		if under(name, p) {
+			e.matched[p] = true
+			found = true
+		}
+	}
+	return found
+}
+
+// fail when a path to extract matched no entry
+func (e *extraction) missing() error {
+	for _, p := range e.only {
+		if !e.matched[p] {
+			return fmt.Errorf("no entry %s in the archive", p)
+		}
+	}
+	return nil
+}
+
+// check an entry name and return the path it extracts to
+// absolute names, names leaving the root, duplicates and paths through symlinks are refused
+func (e *extraction) entry(name string) (string, error) {
+	e.entries++
+	if e.policy.MaxEntries > 0 && e.entries > e.policy.MaxEntries {
+		return "", fmt.Errorf("archive has more than %d entries", e.policy.MaxEntries)
+	}
+	slashed := strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(slashed, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("illegal file path: %s is absolute", name)
+	}
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("illegal file path: %s leaves the output folder", name)
+		}
+	}
+	clean := filepath.Clean(filepath.FromSlash(slashed))
+	if clean == "." {
+		return "", fmt.Errorf("illegal file path: %q", name)
+	}
+	if e.seen[clean] {
+		return "", fmt.Errorf("duplicate entry %s", name)
+	}
+	e.seen[clean] = true
+
+	path := filepath.Join(e.root, clean)
+	// Check for ZipSlip (Directory traversal)
+	if !strings.HasPrefix(path, e.root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal file path: %s", path)
+	}
+	// never write through a link extracted earlier
+	dir := e.root
+	for _, part := range strings.Split(filepath.Dir(clean), string(os.PathSeparator)) {
+		if part == "." {
+			break
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("illegal file path: %s goes through a symlink", name)
+		}
+	}
+	return path, nil
+}
+
+// check a symlink entry against the policy
+// the target is resolved through the links extracted so far, and the link
+// must not redirect the target of an earlier one
+func (e *extraction) symlink(name string, path string, link string) error {
+	if e.policy.Symlinks == SymlinksRefuse {
+		return fmt.Errorf("refusing symlink %s -> %s", name, link)
+	}
+	if filepath.IsAbs(link) || strings.HasPrefix(link, "/") {
+		return fmt.Errorf("illegal symlink %s -> %s: absolute target", name, link)
+	}
+	if e.through[path] {
+		return fmt.Errorf("illegal symlink %s -> %s: an earlier symlink points through it", name, link)
+	}
+	_, err := e.resolve(filepath.Dir(path), link, maxLinkHops)
+	if err != nil {
+		return fmt.Errorf("illegal symlink %s -> %s: %v", name, link, err)
+	}
+	return nil
+}
+
+// resolve the relative link target from the folder dir as the system would,
+// following the links extracted so far, and fail when it leaves the output folder
+func (e *extraction) resolve(dir string, link string, hops int) (string, error) {
+	for _, part := range strings.Split(link, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if dir == e.root {
+				return "", fmt.Errorf("target outside of the output folder")
+			}
+			dir = filepath.Dir(dir)
+			continue
+		}
+		next := filepath.Join(dir, part)
+		info, err := os.Lstat(next)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			e.through[next] = true
+			dir = next
+			continue
+		}
+		if hops == 0 {
+			return "", fmt.Errorf("too many levels of symlinks")
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			return "", fmt.Errorf("target outside of the output folder")
+		}
+		dir, err = e.resolve(dir, target, hops-1)
+		if err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// copy an entry of compressed size compressed from src to dst within the size and ratio limits
+// compressed is 0 for stream archives, their ratio is checked over the whole stream
+func (e *extraction) copy(dst io.Writer, src io.Reader, name string, compressed int64) error {
+	limit := int64(-1)
+	if e.policy.MaxTotalSize > 0 {
+		limit = e.policy.MaxTotalSize - e.total
+	}
+	if e.policy.MaxRatio > 0 && (compressed > 0 || e.stream > 0) {
+		ratioLimit := int64(e.policy.MaxRatio*float64(compressed)) + 1024
+		if compressed == 0 {
+			ratioLimit = int64(e.policy.MaxRatio*float64(e.stream)) + 1024 - e.total
+		}
+		if limit < 0 || ratioLimit < limit {
+			limit = ratioLimit
+		}
+	}
+	if limit >= 0 {
+		src = io.LimitReader(src, limit+1)
+	}
+	n, err := io.Copy(dst, src)
+	e.total += n
+	if err != nil {
+		return err
+	}
+	if limit >= 0 && n > limit {
+		if e.policy.MaxTotalSize > 0 && e.total > e.policy.MaxTotalSize {
+			return fmt.Errorf("archive expands to more than %d bytes", e.policy.MaxTotalSize)
+		}
+		if compressed == 0 {
+			return fmt.Errorf("archive expands more than %.0f times", e.policy.MaxRatio)
+		}
+		return fmt.Errorf("entry %s expands more than %.0f times", name, e.policy.MaxRatio)
+	}
+	return nil
+}
+
+// ask on the terminal whether path may be overwritten
+// stdin is read byte by byte so answers piped in one after another aren't lost
+func askOverwrite(path string) bool {
+	fmt.Printf("%s exists, overwrite? [y/N] ", path)
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if err != nil || (n == 1 && b[0] == '\n') {
+			break
+		}
+		line = append(line, b[:n]...)
+	}
+	answer := strings.ToLower(strings.TrimSpace(string(line)))
+	return answer == "y" || answer == "yes"
+}
+
+// list the paths in dest that moving the tree src into it would replace
+func conflicts(src string, dest string) ([]string, error) {
+	var found []string
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		from := filepath.Join(src, entry.Name())
+		to := filepath.Join(dest, entry.Name())
+		info, err := os.Lstat(to)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// folders are merged, only their contents can conflict
+		if entry.IsDir() && info.IsDir() {
+			inner, err := conflicts(from, to)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, inner...)
+			continue
+		}
+		found = append(found, to)
+	}
+	return found, nil
+}
+
+// move the extracted tree src into dest following the overwrite policy
+// every conflict is resolved before anything is moved, each move is a rename
+func moveTree(src string, dest string, overwrite string) error {
+	found, err := conflicts(src, dest)
+	if err != nil {
+		return err
+	}
+	replace := make(map[string]bool)
+	for _, path := range found {
+		switch overwrite {
+		case OverwriteAlways:
+			replace[path] = true
+		case OverwriteAsk:
+			replace[path] = askOverwrite(path)
+		default:
+			return fmt.Errorf("%s already exists (see -overwrite)", path)
+		}
+	}
+	return mergeTree(src, dest, replace)
+}
+
+// rename the entries of src into dest, merging folders
+// conflicting paths are replaced when listed in replace and skipped otherwise
+func mergeTree(src string, dest string, replace map[string]bool) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		from := filepath.Join(src, entry.Name())
+		to := filepath.Join(dest, entry.Name())
+		info, err := os.Lstat(to)
+		if err == nil {
+			if entry.IsDir() && info.IsDir() {
+				if err := mergeTree(from, to, replace); err != nil {
+					return err
+				}
+				continue
+			}
+			if !replace[to] {
+				continue
+			}
+			if err := os.RemoveAll(to); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extract into a private temporary folder next to outfile and move the
+// result into place only when extract succeeds
+func extractAtomically(outfile string, extract func(tmp string) error) error {
+	parent := filepath.Dir(filepath.Clean(outfile))
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(parent, ".captchazip-extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	err = extract(tmp)
+	if err != nil {
+		return err
+	}
+
+	// a new output folder is moved into place in one rename
+	if _, err := os.Lstat(outfile); os.IsNotExist(err) {
+		err = os.Chmod(tmp, 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp, outfile)
+	} else {
+		err = moveTree(tmp, outfile, ExtractionPolicy.Overwrite)
+	}
+	if err != nil {
+		return err
+	}
+	syncDir(parent)
+	return nil
+}
+
+// write a single file through a private temporary folder next to outfile
+// and move it into place only when extract succeeds
+func extractFileAtomically(outfile string, extract func(tmpfile string) error) error {
+	parent := filepath.Dir(filepath.Clean(outfile))
+	tmp, err := os.MkdirTemp(parent, ".captchazip-extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	name := filepath.Base(filepath.Clean(outfile))
+	err = extract(filepath.Join(tmp, name))
+	if err != nil {
+		return err
+	}
+	err = moveTree(tmp, parent, ExtractionPolicy.Overwrite)
+	if err != nil {
+		return err
+	}
+	syncDir(parent)
+	return nil
+}
@@ -0,0 +1,44 @@
+package zipenc
+
+import (
+	"captcha/captcha_lib/secret"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// links whose targets stay inside the folder as text but leave it on disk
+// (the archived tree is a folder of the output folder, one .. stays inside)
+func TestSymlinkChainConfined(t *testing.T) {
+	chains := map[string][][2]string{
+		// the first link is extracted first and the second resolves through it
+		"through an earlier link": {{"s", "."}, {"x", "s/../.."}},
+		// the first link is extracted first and the second would redirect it
+		"redirecting an earlier link": {{"a", "b/../.."}, {"b", "."}},
+	}
+	for name, links := range chains {
+		t.Run(name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "tree")
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range links {
+				if err := os.Symlink(l[1], filepath.Join(root, l[0])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dir := t.TempDir()
+			bin := filepath.Join(dir, "tree.bin")
+			specs := []SlotSpec{{Label: "password", Key: secret.New([]byte(testPassword))}}
+			if err := ArchiveAndEncrypt(specs, 10, ArchiveOptions{Format: FormatZip}, root, bin); err != nil {
+				t.Fatalf("encrypting: %v", err)
+			}
+			out := filepath.Join(dir, "out")
+			err := DecryptAndUnzipWith(Unlock{Key: secret.New([]byte(testPassword)), Slot: -1}, bin, out)
+			if err == nil || !strings.Contains(err.Error(), "illegal symlink") {
+				t.Fatalf("extracted links leaving the output folder: %v", err)
+			}
+		})
+	}
+}
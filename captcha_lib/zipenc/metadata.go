@@ -0,0 +1,184 @@
+package zipenc
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// zip extra field ids used to carry unix metadata
+const (
+	// Info-ZIP new unix extra field (uid and gid)
+	extraUnixOwner = 0x7875
+	// extended attributes, name/value pairs (this package only)
+	extraXattrs = 0x7861
+)
+
+// when set the owner (uid/gid) of every entry is stored and, when running as root, restored
+var PreserveOwner bool
+
+// when set extended attributes are stored and restored (linux only)
+var PreserveXattrs bool
+
+// when set extended attributes outside the user namespace (security.capability,
+// security.selinux, trusted.*, ...) are restored too, only user.* ones are otherwise
+// since an archive from someone else could grant capabilities or relabel files
+var PreserveSystemXattrs bool
+
+// when set the setuid, setgid and sticky bits of entries are restored, they
+// are stripped otherwise since an archive from someone else could use them
+var PreserveSpecialBits bool
+
+// append one extra field block to extra
+func appendExtra(extra []byte, id uint16, data []byte) []byte {
+	extra = binary.LittleEndian.AppendUint16(extra, id)
+	extra = binary.LittleEndian.AppendUint16(extra, uint16(len(data)))
+	return append(extra, data...)
+}
+
+// split an extra field into its blocks by id
+func parseExtra(extra []byte) map[uint16][]byte {
+	blocks := make(map[uint16][]byte)
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		blocks[id] = extra[4 : 4+size]
+		extra = extra[4+size:]
+	}
+	return blocks
+}
+
+// the extra field blocks holding the metadata zip headers don't carry
+func metadataExtra(path string, info os.FileInfo) []byte {
+	var extra []byte
+	if PreserveOwner {
+		if uid, gid, ok := fileOwner(info); ok {
+			// version 1, 4 byte uid, 4 byte gid
+			data := []byte{1, 4}
+			data = binary.LittleEndian.AppendUint32(data, uint32(uid))
+			data = append(data, 4)
+			data = binary.LittleEndian.AppendUint32(data, uint32(gid))
+			extra = appendExtra(extra, extraUnixOwner, data)
+		}
+	}
+	if PreserveXattrs {
+		attrs, err := listXattrs(path)
+		if err == nil && len(attrs) > 0 {
+			names := make([]string, 0, len(attrs))
+			for name := range attrs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			var data []byte
+			for _, name := range names {
+				data = binary.LittleEndian.AppendUint16(data, uint16(len(name)))
+				data = append(data, name...)
+				data = binary.LittleEndian.AppendUint16(data, uint16(len(attrs[name])))
+				data = append(data, attrs[name]...)
+			}
+			if len(data) <= 0xffff {
+				extra = appendExtra(extra, extraXattrs, data)
+			}
+		}
+	}
+	return extra
+}
+
+// decode the owner stored by metadataExtra
+func extraOwner(data []byte) (int, int, bool) {
+	if len(data) != 11 || data[0] != 1 || data[1] != 4 || data[6] != 4 {
+		return 0, 0, false
+	}
+	uid := binary.LittleEndian.Uint32(data[2:])
+	gid := binary.LittleEndian.Uint32(data[7:])
+	return int(uid), int(gid), true
+}
+
+// decode the extended attributes stored by metadataExtra
+func extraXattrList(data []byte) map[string][]byte {
+	attrs := make(map[string][]byte)
+	for len(data) >= 2 {
+		n := int(binary.LittleEndian.Uint16(data))
+		if 2+n+2 > len(data) {
+			break
+		}
+		name := string(data[2 : 2+n])
+		data = data[2+n:]
+		v := int(binary.LittleEndian.Uint16(data))
+		if 2+v > len(data) {
+			break
+		}
+		attrs[name] = data[2 : 2+v]
+		data = data[2+v:]
+	}
+	return attrs
+}
+
+// the metadata of an archive entry that is restored after extraction
+type entryMeta struct {
+	Mode     os.FileMode
+	Modified time.Time
+	// set when the owner was stored
+	HasOwner bool
+	Uid, Gid int
+	Xattrs   map[string][]byte
+}
+
+// the metadata of a zip entry, owner and extended attributes come from the extra field
+func zipMeta(f *zip.File) entryMeta {
+	meta := entryMeta{Mode: f.Mode(), Modified: f.Modified}
+	blocks := parseExtra(f.Extra)
+	meta.Uid, meta.Gid, meta.HasOwner = extraOwner(blocks[extraUnixOwner])
+	if data, ok := blocks[extraXattrs]; ok {
+		meta.Xattrs = extraXattrList(data)
+	}
+	return meta
+}
+
+// the extended attributes of attrs that are restored, the user.* ones unless PreserveSystemXattrs is set
+func restorableXattrs(attrs map[string][]byte) map[string][]byte {
+	if PreserveSystemXattrs {
+		return attrs
+	}
+	user := make(map[string][]byte, len(attrs))
+	for name, value := range attrs {
+		if strings.HasPrefix(name, "user.") {
+			user[name] = value
+		}
+	}
+	return user
+}
+
+// restore the permission bits, times, owner and extended attributes of an extracted entry
+func restoreMetadata(path string, meta entryMeta) error {
+	isLink := meta.Mode&os.ModeSymlink != 0
+
+	if PreserveOwner && meta.HasOwner && os.Geteuid() == 0 {
+		if err := lchown(path, meta.Uid, meta.Gid); err != nil {
+			return err
+		}
+	}
+	if attrs := restorableXattrs(meta.Xattrs); PreserveXattrs && len(attrs) > 0 {
+		if err := setXattrs(path, attrs); err != nil {
+			return err
+		}
+	}
+	if isLink {
+		return lchtimes(path, meta.Modified)
+	}
+	// chmod after writing so the umask doesn't strip bits
+	mode := meta.Mode.Perm()
+	if PreserveSpecialBits {
+		mode |= meta.Mode & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, meta.Modified, meta.Modified)
+}
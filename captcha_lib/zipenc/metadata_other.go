@@ -0,0 +1,22 @@
+//go:build !unix
+
+package zipenc
+
+import (
+	"os"
+	"time"
+)
+
+// owners are not available outside unix
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+func lchown(path string, uid int, gid int) error {
+	return nil
+}
+
+// symlink times cannot be set without following the link here
+func lchtimes(path string, t time.Time) error {
+	return nil
+}
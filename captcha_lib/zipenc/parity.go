@@ -0,0 +1,366 @@
+package zipenc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+/***
+
+error-correcting parity (Reed-Solomon)
+
+a container can be followed by parity that repairs damaged bytes before
+the ciphertext is authenticated. the container is cut into groups of
+parityData shards, every group gets as many parity shards as the redundancy
+asks for and every shard is hashed so repair knows which shards are damaged.
+a group survives as many damaged shards as it has parity shards
+
+shards are about twice the square root of the container long and groups
+are as large as GF(256) allows, so damage scattered over the file spreads
+thinly over the groups
+
+the parity section is appended after the container as
+
+	parity shards | descriptor | descriptor | descriptor length (8 bytes) | section length (8 bytes) | parityMagic
+
+a descriptor is the length of its json part (4 bytes), the json part, the
+shard hashes and the SHA256 of all of it. it is written twice so a damaged
+copy doesn't lose the parity
+
+***/
+
+const (
+	// the most data and parity shards of a group
+	maxShards = 256
+	// the smallest and largest shard
+	minShard = 512
+	maxShard = 64 << 10
+	// the shard hashes are truncated SHA256, enough to find damage
+	shardHash = 16
+	// marks the end of a file carrying parity
+	parityMagic = "CZPARITY"
+	// the fixed size end of the parity section
+	parityTrailer = 8 + 8 + len(parityMagic)
+)
+
+// how the parity of a container is laid out
+type parityDescriptor struct {
+	// the redundancy in percent the parity was made with
+	Redundancy int `json:"Redundancy"`
+	// the length of the container the parity protects
+	Size      int64 `json:"Size"`
+	ShardSize int   `json:"ShardSize"`
+	Data      int   `json:"Data"`
+	Parity    int   `json:"Parity"`
+	// the hash of every shard, group by group, data shards first
+	Hashes []byte `json:"-"`
+}
+
+// lay out the parity of a container of size bytes
+func newParity(size int64, redundancy int) parityDescriptor {
+	d := parityDescriptor{Redundancy: redundancy, Size: size}
+	d.ShardSize = int(min(maxShard, max(minShard, 2*int64(math.Sqrt(float64(size))))))
+	// as few groups as leave room for the parity, with the shards spread evenly over them
+	shards := max(1, (size+int64(d.ShardSize)-1)/int64(d.ShardSize))
+	perGroup := int64(maxShards * 100 / (100 + redundancy))
+	groups := (shards + perGroup - 1) / perGroup
+	d.Data = int((shards + groups - 1) / groups)
+	d.Parity = (d.Data*redundancy + 99) / 100
+	return d
+}
+
+// the hash of shard i of group g
+func (d parityDescriptor) hash(g int, i int) []byte {
+	offset := (g*(d.Data+d.Parity) + i) * shardHash
+	return d.Hashes[offset : offset+shardHash]
+}
+
+// the descriptor as it is stored
+func (d parityDescriptor) marshal() ([]byte, error) {
+	js, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(js)))
+	b = append(append(b, js...), d.Hashes...)
+	sum := sha256.Sum256(b)
+	return append(b, sum[:]...), nil
+}
+
+// parse a stored descriptor, false when it is damaged
+func unmarshalParity(b []byte) (parityDescriptor, bool) {
+	var d parityDescriptor
+	if len(b) < 4+sha256.Size {
+		return d, false
+	}
+	body, sum := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	check := sha256.Sum256(body)
+	if !bytes.Equal(check[:], sum) {
+		return d, false
+	}
+	n := int(binary.BigEndian.Uint32(body))
+	if 4+n > len(body) || json.Unmarshal(body[4:4+n], &d) != nil {
+		return d, false
+	}
+	d.Hashes = body[4+n:]
+	return d, true
+}
+
+// the number of groups the container is cut into
+func (d parityDescriptor) groups() int {
+	group := int64(d.Data * d.ShardSize)
+	return int((d.Size + group - 1) / group)
+}
+
+// the shards of group g, data read from container and parity read from parity
+// the last data shards are padded with zeros
+func (d parityDescriptor) shards(container io.ReaderAt, parity io.ReaderAt, g int) ([][]byte, error) {
+	shards := make([][]byte, d.Data+d.Parity)
+	start := int64(g) * int64(d.Data*d.ShardSize)
+	for i := range shards {
+		shards[i] = make([]byte, d.ShardSize)
+		if i >= d.Data {
+			offset := int64(g*d.Parity+i-d.Data) * int64(d.ShardSize)
+			if parity == nil {
+				continue
+			}
+			_, err := parity.ReadAt(shards[i], offset)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		offset := start + int64(i*d.ShardSize)
+		if offset >= d.Size {
+			continue
+		}
+		n := min(int64(d.ShardSize), d.Size-offset)
+		_, err := container.ReadAt(shards[i][:n], offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shards, nil
+}
+
+// append parity for the size bytes written to f so far
+// nothing is appended when redundancy is 0
+func appendParity(f *os.File, redundancy int) error {
+	if redundancy == 0 {
+		return nil
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	d := newParity(size, redundancy)
+	enc, err := reedsolomon.New(d.Data, d.Parity)
+	if err != nil {
+		return err
+	}
+
+	var written int64
+	for g := 0; g < d.groups(); g++ {
+		shards, err := d.shards(f, nil, g)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(shards)
+		if err != nil {
+			return err
+		}
+		for _, shard := range shards {
+			sum := sha256.Sum256(shard)
+			d.Hashes = append(d.Hashes, sum[:shardHash]...)
+		}
+		for _, shard := range shards[d.Data:] {
+			n, err := f.Write(shard)
+			written += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	desc, err := d.marshal()
+	if err != nil {
+		return err
+	}
+	trailer := binary.BigEndian.AppendUint64(nil, uint64(len(desc)))
+	trailer = binary.BigEndian.AppendUint64(trailer, uint64(written+2*int64(len(desc))+int64(parityTrailer)))
+	trailer = append(trailer, parityMagic...)
+	for _, b := range [][]byte{desc, desc, trailer} {
+		_, err = f.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the length of the parity section at the end of a file of the given size
+// read from r and of one descriptor copy in it, 0 when the file has no parity
+func paritySection(r io.ReaderAt, size int64) (int64, int64) {
+	if size < int64(parityTrailer) {
+		return 0, 0
+	}
+	trailer := make([]byte, parityTrailer)
+	_, err := r.ReadAt(trailer, size-int64(parityTrailer))
+	if err != nil || string(trailer[16:]) != parityMagic {
+		return 0, 0
+	}
+	descLen := int64(binary.BigEndian.Uint64(trailer))
+	section := int64(binary.BigEndian.Uint64(trailer[8:]))
+	if section > size || descLen < 4+sha256.Size || 2*descLen+int64(parityTrailer) > section {
+		return 0, 0
+	}
+	return section, descLen
+}
+
+// the length of the container in a file of the given size, without its parity
+func containerSize(r io.ReaderAt, size int64) int64 {
+	section, _ := paritySection(r, size)
+	return size - section
+}
+
+// read the parity descriptor of a file held in data
+// returns the descriptor and whether one of its copies is damaged
+func readParity(data []byte) (parityDescriptor, bool, error) {
+	var d parityDescriptor
+	section, descLen := paritySection(bytes.NewReader(data), int64(len(data)))
+	if section == 0 {
+		return d, false, fmt.Errorf("the file carries no parity (or its end is damaged)")
+	}
+	end := int64(len(data)) - int64(parityTrailer)
+	copies := [][]byte{data[end-2*descLen : end-descLen], data[end-descLen : end]}
+	var found []parityDescriptor
+	for _, c := range copies {
+		if d, ok := unmarshalParity(c); ok {
+			found = append(found, d)
+		}
+	}
+	damaged := len(found) < len(copies)
+	if len(found) == 0 {
+		return d, damaged, fmt.Errorf("both copies of the parity descriptor are damaged")
+	}
+	d = found[0]
+	if d.Size != int64(len(data))-section || d.Data < 1 || d.Parity < 1 || d.Data+d.Parity > maxShards || d.ShardSize < 1 ||
+		len(d.Hashes) != d.groups()*(d.Data+d.Parity)*shardHash {
+		return d, damaged, fmt.Errorf("the parity doesn't match the file")
+	}
+	return d, damaged, nil
+}
+
+// whether file carries parity
+func HasParity(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	section, _ := paritySection(f, info.Size())
+	return section > 0
+}
+
+// the outcome of a repair
+type RepairResult struct {
+	// the shards found damaged and rebuilt
+	Repaired int
+	// whether a copy of the parity descriptor was damaged
+	Descriptor bool
+}
+
+// find the damaged shards of file through the parity hashes and rebuild them
+// the repaired file is written to outfile (which may be file), nothing is
+// written when nothing is damaged. no key is needed, the parity covers the ciphertext
+func Repair(file string, outfile string) (RepairResult, error) {
+	var result RepairResult
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return result, err
+	}
+	d, damaged, err := readParity(data)
+	if err != nil {
+		return result, err
+	}
+	result.Descriptor = damaged
+	enc, err := reedsolomon.New(d.Data, d.Parity)
+	if err != nil {
+		return result, err
+	}
+
+	container := data[:d.Size]
+	parity := bytes.NewReader(data[d.Size:])
+	for g := 0; g < d.groups(); g++ {
+		shards, err := d.shards(bytes.NewReader(container), parity, g)
+		if err != nil {
+			return result, err
+		}
+		bad := 0
+		for i, shard := range shards {
+			sum := sha256.Sum256(shard)
+			if !bytes.Equal(sum[:shardHash], d.hash(g, i)) {
+				shards[i] = nil
+				bad++
+			}
+		}
+		if bad == 0 {
+			continue
+		}
+		if bad > d.Parity {
+			return result, fmt.Errorf("%d shards of group %d are damaged, at most %d can be repaired", bad, g, d.Parity)
+		}
+		err = enc.Reconstruct(shards)
+		if err != nil {
+			return result, err
+		}
+		// copy the rebuilt data shards back, the parity is written anew below
+		start := int64(g) * int64(d.Data*d.ShardSize)
+		for i := 0; i < d.Data; i++ {
+			offset := start + int64(i*d.ShardSize)
+			if offset >= d.Size {
+				break
+			}
+			copy(container[offset:], shards[i][:min(int64(d.ShardSize), d.Size-offset)])
+		}
+		result.Repaired += bad
+	}
+	if result.Repaired == 0 && !result.Descriptor && outfile == file {
+		return result, nil
+	}
+
+	// the parity is computed again, it comes out the same as the undamaged original
+	return result, writeAtomic(outfile, 0644, func(f *os.File) error {
+		_, err := f.Write(container)
+		if err != nil {
+			return err
+		}
+		return appendParity(f, d.Redundancy)
+	})
+}
+
+// write file to outfile (which may be file) with parity of redundancy percent (0 removes it)
+// the header records the redundancy so rewriting the file keeps it
+func SetParity(file string, outfile string, redundancy int) error {
+	if redundancy < 0 || redundancy > 100 {
+		return fmt.Errorf("parity redundancy %d%% is not between 0 and 100", redundancy)
+	}
+	header, payload, err := readContainer(file)
+	if err != nil {
+		return err
+	}
+	header.Parity = redundancy
+	return writeContainer(outfile, header, payload)
+}
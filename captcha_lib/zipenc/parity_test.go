@@ -0,0 +1,137 @@
+package zipenc
+
+import (
+	"bytes"
+	"captcha/captcha_lib/secret"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the book the parity is tested with
+const testBook = "../../hhgttg.txt"
+
+// encrypt the book with parity of redundancy percent, returning the container and its descriptor
+func encryptWithParity(t *testing.T, redundancy int) (string, parityDescriptor) {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "hhgttg.bin")
+	specs := []SlotSpec{{Label: "password", Key: secret.New([]byte(testPassword))}}
+	opts := ArchiveOptions{Format: FormatRaw, Parity: redundancy}
+	if err := ArchiveAndEncrypt(specs, 10, opts, testBook, bin); err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	data, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, damaged, err := readParity(data)
+	if err != nil || damaged {
+		t.Fatalf("reading the parity: %v (damaged %v)", err, damaged)
+	}
+	return bin, d
+}
+
+// flip a random byte in n distinct data shards of each of the first groups of the container in data
+// the groups must be whole, the last one can be short
+func damageShards(rng *rand.Rand, data []byte, d parityDescriptor, groups int, n int) {
+	for g := 0; g < groups; g++ {
+		start := int64(g) * int64(d.Data*d.ShardSize)
+		for _, i := range rng.Perm(d.Data)[:n] {
+			offset := start + int64(i*d.ShardSize)
+			size := min(int64(d.ShardSize), d.Size-offset)
+			data[offset+rng.Int63n(size)] ^= byte(1 + rng.Intn(255))
+		}
+	}
+}
+
+// decrypt bin and check it gives the book back
+func decryptBook(t *testing.T, bin string) error {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "hhgttg.txt")
+	unlock := Unlock{Key: secret.New([]byte(testPassword)), Slot: -1}
+	if err := DecryptAndUnzipWith(unlock, bin, out); err != nil {
+		return err
+	}
+	want, err := os.ReadFile(testBook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatal("the decrypted book differs from the original")
+	}
+	return nil
+}
+
+func TestRepairRandomDamage(t *testing.T) {
+	bin, d := encryptWithParity(t, 10)
+	original, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(42))
+	data := bytes.Clone(original)
+	// the last group can have fewer real shards than damaged ones asked for
+	damageShards(rng, data, d, d.groups()-1, d.Parity)
+	if err := os.WriteFile(bin, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptBook(t, bin); err == nil {
+		t.Fatal("the damaged container decrypted")
+	}
+
+	result, err := Repair(bin, bin)
+	if err != nil {
+		t.Fatalf("repairing: %v", err)
+	}
+	if want := (d.groups() - 1) * d.Parity; result.Repaired != want {
+		t.Errorf("repaired %d shards, want %d", result.Repaired, want)
+	}
+	repaired, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(original, repaired) {
+		t.Error("the repaired file differs from the original")
+	}
+	if err := decryptBook(t, bin); err != nil {
+		t.Fatalf("decrypting the repaired container: %v", err)
+	}
+}
+
+func TestRepairTooMuchDamage(t *testing.T) {
+	bin, d := encryptWithParity(t, 10)
+	data, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damageShards(rand.New(rand.NewSource(7)), data, d, 1, d.Parity+1)
+	if err := os.WriteFile(bin, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "repaired.bin")
+	if _, err := Repair(bin, out); err == nil {
+		t.Fatal("repaired more damaged shards than there is parity")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("a repair that failed wrote %s", out)
+	}
+	if _, err := Repair(bin, bin); err == nil {
+		t.Fatal("repaired more damaged shards than there is parity in place")
+	}
+	kept, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, kept) {
+		t.Error("a repair that failed changed the file")
+	}
+	if err := decryptBook(t, bin); err == nil {
+		t.Fatal("the damaged container decrypted")
+	}
+}
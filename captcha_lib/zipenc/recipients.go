@@ -0,0 +1,251 @@
+package zipenc
+
+import (
+	"bytes"
+	"captcha/captcha_lib/chess"
+	"captcha/captcha_lib/hashpuzzle"
+	"captcha/captcha_lib/secret"
+	"captcha/captcha_lib/sudoku"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// prefixes of the text encodings of X25519 keys (age style)
+const (
+	RecipientPrefix = "captcha-pub-"
+	IdentityPrefix  = "CAPTCHA-SECRET-KEY-"
+)
+
+// the slot type of a data key wrapped to an X25519 public key
+const slotX25519 = "x25519"
+
+// generate a new X25519 identity (private key)
+func GenerateIdentity() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// encode a public key as a recipient string
+func EncodeRecipient(pub *ecdh.PublicKey) string {
+	return RecipientPrefix + base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+// parse a recipient string produced by EncodeRecipient
+func ParseRecipient(s string) (*ecdh.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, RecipientPrefix) {
+		return nil, fmt.Errorf("recipient %q does not start with %s", s, RecipientPrefix)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, RecipientPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("decoding recipient: %v", err)
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// encode a private key as an identity
+func EncodeIdentity(priv *ecdh.PrivateKey) *secret.Secret {
+	raw := priv.Bytes()
+	defer secret.Wipe(raw)
+	b := make([]byte, len(IdentityPrefix)+base64.RawURLEncoding.EncodedLen(len(raw)))
+	copy(b, IdentityPrefix)
+	base64.RawURLEncoding.Encode(b[len(IdentityPrefix):], raw)
+	return secret.New(b)
+}
+
+// parse an identity produced by EncodeIdentity
+func ParseIdentity(b []byte) (*ecdh.PrivateKey, error) {
+	b = bytes.TrimSpace(b)
+	if !bytes.HasPrefix(b, []byte(IdentityPrefix)) {
+		return nil, fmt.Errorf("identity does not start with %s", IdentityPrefix)
+	}
+	b = b[len(IdentityPrefix):]
+	raw := make([]byte, base64.RawURLEncoding.DecodedLen(len(b)))
+	defer secret.Wipe(raw)
+	n, err := base64.RawURLEncoding.Decode(raw, b)
+	if err != nil {
+		return nil, fmt.Errorf("decoding identity: %v", err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw[:n])
+}
+
+// read the non empty, non comment lines of a key file
+// the lines point into the returned content, which identity files wipe when done
+func readKeyLines(file string) ([]byte, [][]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var lines [][]byte
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return content, lines, nil
+}
+
+// read a recipients file, one recipient per line, '#' starts a comment
+func ReadRecipientsFile(file string) ([]*ecdh.PublicKey, error) {
+	_, lines, err := readKeyLines(file)
+	if err != nil {
+		return nil, err
+	}
+	var recipients []*ecdh.PublicKey
+	for _, line := range lines {
+		pub, err := ParseRecipient(string(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		recipients = append(recipients, pub)
+	}
+	return recipients, nil
+}
+
+// read an identity file written by WriteIdentityFile
+func ReadIdentityFile(file string) ([]*ecdh.PrivateKey, error) {
+	content, lines, err := readKeyLines(file)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Wipe(content)
+	var identities []*ecdh.PrivateKey
+	for _, line := range lines {
+		priv, err := ParseIdentity(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		identities = append(identities, priv)
+	}
+	return identities, nil
+}
+
+// write a new identity file readable only by the owner
+func WriteIdentityFile(file string, priv *ecdh.PrivateKey) error {
+	identity := EncodeIdentity(priv)
+	defer identity.Wipe()
+	header := "# created: " + time.Now().Format(time.RFC3339) + "\n" +
+		"# public key: " + EncodeRecipient(priv.PublicKey()) + "\n"
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(header)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(identity.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString("\n")
+	return err
+}
+
+// HKDF-SHA256 (RFC 5869) producing a single 32 byte block
+func hkdfKey(ikm []byte, salt []byte, info string) []byte {
+	okm := make([]byte, sha256.Size)
+	// one block is far below the most HKDF can expand to, the read can't fail
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte(info)), okm); err != nil {
+		panic(err)
+	}
+	return okm
+}
+
+// derive the secret shared between an ephemeral key and a recipient
+// it seeds the recipient's puzzles and (with the puzzle keys) the slot key
+// shared is wiped
+func recipientSecret(shared []byte, ephemeral []byte, recipient []byte) *secret.Secret {
+	defer secret.Wipe(shared)
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	okm := hkdfKey(shared, salt, "captcha-x25519")
+	defer secret.Wipe(okm)
+	return secret.Hex(okm)
+}
+
+// wrap the data key to an X25519 recipient
+// the puzzles in spec.Puzzles are solved here so the recipient has to solve them too
+func wrapKeyRecipient(key *secret.Secret, spec SlotSpec, N uint16) (KeySlot, error) {
+	var slot KeySlot
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return slot, err
+	}
+	shared, err := eph.ECDH(spec.Recipient)
+	if err != nil {
+		return slot, err
+	}
+	seed := recipientSecret(shared, eph.PublicKey().Bytes(), spec.Recipient.Bytes())
+	defer seed.Wipe()
+
+	PuzzleKey, err := solvePuzzleKeys(seed, spec.Puzzles, spec.ChessOptions, N)
+	defer wipeAll(PuzzleKey[:])
+	if err != nil {
+		return slot, err
+	}
+
+	slot, err = wrapKey(key, SlotSpec{Label: spec.Label, Key: seed, Puzzles: spec.Puzzles, PuzzleKey: PuzzleKey, ChessOptions: spec.ChessOptions}, N)
+	if err != nil {
+		return slot, err
+	}
+	slot.Type = slotX25519
+	slot.Recipient = EncodeRecipient(spec.Recipient)
+	slot.Ephemeral = base64.StdEncoding.EncodeToString(eph.PublicKey().Bytes())
+	return slot, nil
+}
+
+// solve the puzzles selected (sudoku, chess, hashpuzzle order) for seed without asking
+// used when a key is wrapped for whoever solves the puzzles later
+// the chess puzzles are made with chessOpts (the defaults when nil)
+func solvePuzzleKeys(seed *secret.Secret, puzzles [3]bool, chessOpts *chess.ChessOptions, N uint16) ([3]*secret.Secret, error) {
+	var PuzzleKey [3]*secret.Secret
+	if puzzles[0] {
+		PuzzleKey[0] = sudoku.SolvePuzzleKey(seed, N)
+	}
+	if puzzles[1] {
+		var err error
+		PuzzleKey[1], err = chess.SolvePuzzleKey(seed, chessOpts)
+		if err != nil {
+			return PuzzleKey, err
+		}
+	}
+	if puzzles[2] {
+		PuzzleKey[2] = hashpuzzle.SolveHashKey(seed)
+	}
+	return PuzzleKey, nil
+}
+
+// find the identity a recipient slot was wrapped to and recover the slot secret
+func recipientSlotSecret(slot KeySlot, identities []*ecdh.PrivateKey) (*secret.Secret, error) {
+	ephB, err := base64.StdEncoding.DecodeString(slot.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("decoding ephemeral key: %v", err)
+	}
+	eph, err := ecdh.X25519().NewPublicKey(ephB)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range identities {
+		if EncodeRecipient(id.PublicKey()) != slot.Recipient {
+			continue
+		}
+		shared, err := id.ECDH(eph)
+		if err != nil {
+			return nil, err
+		}
+		return recipientSecret(shared, ephB, id.PublicKey().Bytes()), nil
+	}
+	return nil, fmt.Errorf("no identity matches recipient %s (%w)", slot.Recipient, ErrWrongKey)
+}
@@ -0,0 +1,36 @@
+package zipenc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// the keys derived must stay those of files already written
+func TestHKDF(t *testing.T) {
+	vectors := []struct {
+		ikm, salt, info string
+		want            string
+	}{
+		// RFC 5869 A.1, the first block of its output
+		{
+			ikm:  string(bytes.Repeat([]byte{0x0b}, 22)),
+			salt: "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c",
+			info: "\xf0\xf1\xf2\xf3\xf4\xf5\xf6\xf7\xf8\xf9",
+			want: "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf",
+		},
+		// derived by the earlier implementation
+		{"the shared secret", "ephemeral|recipient", "captcha-x25519", "9cd68887ef6aff717d0d99c3c3cd3fbdf002179bae88934884ffd79fe04b9b9e"},
+		{"data key", "", "captcha-index", "09ea23128667ab61d146ac656fd7f2f9bba84f16087fbd4b7d1238e6c325334f"},
+	}
+	for _, v := range vectors {
+		var salt []byte
+		if v.salt != "" {
+			salt = []byte(v.salt)
+		}
+		got := hex.EncodeToString(hkdfKey([]byte(v.ikm), salt, v.info))
+		if got != v.want {
+			t.Errorf("hkdf(%q, %q) = %s, want %s", v.ikm, v.info, got, v.want)
+		}
+	}
+}
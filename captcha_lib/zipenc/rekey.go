@@ -0,0 +1,117 @@
+package zipenc
+
+import (
+	"captcha/captcha_lib/secret"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+/***
+
+re-keying an encrypted file in place
+
+by default only the slot that was unlocked is replaced, the data key and
+payload stay the same so this is as cheap as adding a slot. rotating the
+data key re-encrypts the payload in memory, the plaintext never touches
+the disk
+
+***/
+
+// how a file is re-keyed
+type RekeyOptions struct {
+	// the slot replacing the unlocked one, an empty label keeps the old label
+	Spec SlotSpec
+	// the hash iterations of the new slot
+	N uint16
+	// generate a new data key and re-encrypt the payload under it
+	// every other slot is dropped as it still wraps the old data key
+	Rotate bool
+}
+
+// the outcome of a re-key
+type RekeyResult struct {
+	// the slot that was replaced (-1 for a file written before key slots existed)
+	Slot int
+	// whether the payload was re-encrypted under a new data key
+	Rotated bool
+	// the number of other slots dropped by the rotation
+	Dropped int
+}
+
+// replace the slot opened by unlock with opts.Spec
+// files written before key slots existed are always re-encrypted
+func Rekey(unlock Unlock, opts RekeyOptions, file string) (RekeyResult, error) {
+	var result RekeyResult
+	header, payload, err := readContainer(file)
+	if err != nil {
+		return result, err
+	}
+	if err := checkPolicy([]SlotSpec{opts.Spec}, opts.N); err != nil {
+		return result, err
+	}
+	key, index, err := unlockSlot(unlock, header)
+	if err != nil {
+		return result, fmt.Errorf("unlock: %w", err)
+	}
+	defer key.Wipe()
+	result.Slot = index
+
+	spec := opts.Spec
+	if spec.Label == "" && index >= 0 {
+		spec.Label = header.Slots[index].Label
+	}
+	if spec.Label == "" {
+		spec.Label = "password"
+	}
+
+	if !opts.Rotate && index >= 0 {
+		slot, err := newSlot(key, spec, opts.N)
+		if err != nil {
+			return result, err
+		}
+		header.Slots[index] = slot
+		return result, writeContainer(file, header, payload)
+	}
+
+	newKey := secret.New(make([]byte, 32))
+	defer newKey.Wipe()
+	_, err = io.ReadFull(rand.Reader, newKey.Bytes())
+	if err != nil {
+		return result, fmt.Errorf("data key: %v", err)
+	}
+	slot, err := newSlot(newKey, spec, opts.N)
+	if err != nil {
+		return result, err
+	}
+	payload, err = reseal(header, payload, key, newKey)
+	if err != nil {
+		return result, err
+	}
+
+	if index >= 0 {
+		result.Dropped = len(header.Slots) - 1
+	}
+	// the legacy fields only describe the old key derivation
+	archive := header.archive()
+	header = ContextHeaderStruct{Slots: []KeySlot{slot}, Format: archive.Format, Compression: archive.Compression, Parity: header.Parity}
+	result.Rotated = true
+	return result, writeContainer(file, header, payload)
+}
+
+// re-encrypt a payload from key under newKey, the plaintext is only held in memory
+func reseal(header ContextHeaderStruct, payload []byte, key *secret.Secret, newKey *secret.Secret) ([]byte, error) {
+	if header.Format == FormatEntries {
+		return resealEntries(payload, key, newKey)
+	}
+	plainText, err := open(key.Bytes(), payload)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt file: %v", err)
+	}
+	defer secret.Wipe(plainText)
+	payload, err = seal(newKey.Bytes(), plainText)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %v", err)
+	}
+	return payload, nil
+}
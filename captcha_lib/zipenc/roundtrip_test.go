@@ -0,0 +1,191 @@
+package zipenc
+
+import (
+	"bytes"
+	"captcha/captcha_lib/secret"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the password of the test files, strong enough for PasswordPolicy
+const testPassword = "correct-Horse7battery#staple"
+
+// a tree with file modes, mtimes, a symlink and an empty directory
+func makeTree(t *testing.T) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "tree")
+	files := []struct {
+		name string
+		data string
+		mode os.FileMode
+	}{
+		{"a.txt", "the answer is 42\n", 0644},
+		{"run.sh", "#!/bin/sh\necho hi\n", 0755},
+		{"sub/private.txt", "don't panic\n", 0600},
+		{"sub/deeper/b.bin", string(bytes.Repeat([]byte{0, 1, 2, 3}, 1000)), 0640},
+	}
+	when := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for i, f := range files {
+		path := filepath.Join(root, f.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f.data), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, f.mode); err != nil {
+			t.Fatal(err)
+		}
+		mtime := when.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/private.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// encrypt root with format and decrypt it again, returning the tree decrypted
+func roundTrip(t *testing.T, root string, format string) string {
+	t.Helper()
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "tree.bin")
+	key := secret.New([]byte(testPassword))
+	specs := []SlotSpec{{Label: "password", Key: key}}
+	if err := ArchiveAndEncrypt(specs, 10, ArchiveOptions{Format: format}, root, bin); err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	out := filepath.Join(dir, "out")
+	unlock := Unlock{Key: secret.New([]byte(testPassword)), Slot: -1}
+	if err := DecryptAndUnzipWith(unlock, bin, out); err != nil {
+		t.Fatalf("decrypting: %v", err)
+	}
+	return filepath.Join(out, filepath.Base(root))
+}
+
+// check that got holds the same entries as want with the same contents, modes, mtimes and links
+func compareTrees(t *testing.T, want string, got string) {
+	t.Helper()
+	seen := 0
+	err := filepath.WalkDir(want, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(want, path)
+		if rel == "." {
+			return nil
+		}
+		seen++
+		wi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		gi, err := os.Lstat(filepath.Join(got, rel))
+		if err != nil {
+			t.Errorf("%s: %v", rel, err)
+			return nil
+		}
+		if wi.Mode() != gi.Mode() {
+			t.Errorf("%s: mode %v, want %v", rel, gi.Mode(), wi.Mode())
+		}
+		switch {
+		case wi.Mode()&os.ModeSymlink != 0:
+			wl, _ := os.Readlink(path)
+			gl, _ := os.Readlink(filepath.Join(got, rel))
+			if wl != gl {
+				t.Errorf("%s: links to %q, want %q", rel, gl, wl)
+			}
+		case wi.Mode().IsRegular():
+			if !wi.ModTime().Equal(gi.ModTime()) {
+				t.Errorf("%s: modified %v, want %v", rel, gi.ModTime(), wi.ModTime())
+			}
+			wd, _ := os.ReadFile(path)
+			gd, _ := os.ReadFile(filepath.Join(got, rel))
+			if !bytes.Equal(wd, gd) {
+				t.Errorf("%s: contents differ", rel)
+			}
+		case wi.IsDir():
+			entries, _ := os.ReadDir(filepath.Join(got, rel))
+			wentries, _ := os.ReadDir(path)
+			if len(entries) != len(wentries) {
+				t.Errorf("%s: %d entries, want %d", rel, len(entries), len(wentries))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen == 0 {
+		t.Fatal("nothing compared")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatZip, FormatTar} {
+		t.Run(format, func(t *testing.T) {
+			root := makeTree(t)
+			compareTrees(t, root, roundTrip(t, root, format))
+		})
+	}
+}
+
+func TestSpecialBitsStripped(t *testing.T) {
+	root := makeTree(t)
+	path := filepath.Join(root, "run.sh")
+	if err := os.Chmod(path, 0755|os.ModeSetuid|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	for _, preserve := range []bool{false, true} {
+		PreserveSpecialBits = preserve
+		info, err := os.Stat(filepath.Join(roundTrip(t, root, FormatZip), "run.sh"))
+		PreserveSpecialBits = false
+		if err != nil {
+			t.Fatal(err)
+		}
+		special := info.Mode() & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if preserve && special != os.ModeSetuid|os.ModeSetgid {
+			t.Errorf("special bits %v not restored with PreserveSpecialBits", special)
+		}
+		if !preserve && special != 0 {
+			t.Errorf("special bits %v restored from the archive", special)
+		}
+	}
+}
+
+// deflate streams outside zip are gzip and recorded so, files recording them as deflate still open
+func TestGzipStreams(t *testing.T) {
+	root := makeTree(t)
+	bin := filepath.Join(t.TempDir(), "tree.bin")
+	specs := []SlotSpec{{Label: "password", Key: secret.New([]byte(testPassword))}}
+	opts := ArchiveOptions{Format: FormatTar, Compression: CompressDeflate}
+	if err := ArchiveAndEncrypt(specs, 10, opts, root, bin); err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	header, payload, err := readContainer(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Compression != CompressGzip {
+		t.Errorf("a deflated tar stream is recorded as %q", header.Compression)
+	}
+
+	// as written before gzip was named
+	header.Compression = CompressDeflate
+	if err := writeContainer(bin, header, payload); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if err := DecryptAndUnzipWith(Unlock{Key: secret.New([]byte(testPassword)), Slot: -1}, bin, out); err != nil {
+		t.Fatalf("decrypting: %v", err)
+	}
+	compareTrees(t, root, filepath.Join(out, filepath.Base(root)))
+}
@@ -0,0 +1,209 @@
+package zipenc
+
+import (
+	"captcha/captcha_lib/secret"
+	"captcha/captcha_lib/shamir"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+/***
+
+escrow of the data key in Shamir shares
+
+the data key of a file is split into shares any threshold of which recover
+it. every share is written to a small file of its own, wrapped into a key
+slot like the ones in the header, so it is protected by its holder's
+password, puzzles and hash iterations. the shares hold the data key and not
+a password, they keep working when slots are added or changed but not after
+the data key is rotated
+
+a share file carries a check derived from the data key so shares from
+different splits, or too few of them, are told apart from a right key
+
+***/
+
+// marks a share file
+const shareType = "captcha-share"
+
+// a share file as stored
+type shareFile struct {
+	Type string `json:"Type"`
+	// random, the same in every share of one split
+	ID string `json:"ID"`
+	// the file the key was split from, for the holder's information
+	File      string `json:"File"`
+	Threshold int    `json:"Threshold"`
+	Shares    int    `json:"Shares"`
+	// the x of the share, from 1
+	Index int `json:"Index"`
+	// derived from the data key, tells whether the combined key is right
+	Check string `json:"Check"`
+	// the share wrapped under the holder's password and puzzles
+	Slot KeySlot `json:"Slot"`
+}
+
+// a share read from its file, Open unwraps it
+type Share struct {
+	// the holder the share was made for
+	Label     string
+	Index     int
+	Threshold int
+	Shares    int
+	// the file the key was split from
+	File  string
+	f     shareFile
+	value *secret.Secret
+}
+
+// the name of share i (from 1) written for file
+func shareName(file string, i int) string {
+	return fmt.Sprintf("%s.%d.share", file, i)
+}
+
+// the check of a data key stored in every share of a split
+func shareCheck(key *secret.Secret, id []byte) string {
+	check := hkdfKey(key.Bytes(), id, "captcha-share-check")
+	return base64.StdEncoding.EncodeToString(check)
+}
+
+// split the data key of file into one share per holder, threshold of which recover it
+// each share is wrapped under its holder's spec and written to outfile.<i>.share
+// returns the names of the share files
+func SplitKey(unlock Unlock, file string, threshold int, holders []SlotSpec, N uint16, outfile string) ([]string, error) {
+	header, _, err := readContainer(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPolicy(holders, N); err != nil {
+		return nil, err
+	}
+	key, err := unlockKey(unlock, header)
+	if err != nil {
+		return nil, fmt.Errorf("unlock: %w", err)
+	}
+	defer key.Wipe()
+
+	shares, err := shamir.Split(key.Bytes(), len(holders), threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeShares(shares)
+	id := make([]byte, 16)
+	_, err = io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for i, spec := range holders {
+		value := secret.Copy(shares[i])
+		slot, err := newSlot(value, spec, N)
+		value.Wipe()
+		if err != nil {
+			return nil, fmt.Errorf("share %d (%s): %v", i+1, spec.Label, err)
+		}
+		sf := shareFile{
+			Type:      shareType,
+			ID:        base64.StdEncoding.EncodeToString(id),
+			File:      file,
+			Threshold: threshold,
+			Shares:    len(holders),
+			Index:     i + 1,
+			Check:     shareCheck(key, id),
+			Slot:      slot,
+		}
+		b, err := json.MarshalIndent(sf, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		name := shareName(outfile, i+1)
+		err = writeFileAtomic(name, append(b, '\n'), 0600)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// wipe the shares split from a data key
+func wipeShares(shares [][]byte) {
+	for _, s := range shares {
+		secret.Wipe(s)
+	}
+}
+
+// read a share file without unwrapping the share
+func ReadShare(file string) (*Share, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var sf shareFile
+	err = json.Unmarshal(b, &sf)
+	if err != nil || sf.Type != shareType {
+		return nil, fmt.Errorf("%s is not a share file", file)
+	}
+	return &Share{Label: sf.Slot.Label, Index: sf.Index, Threshold: sf.Threshold, Shares: sf.Shares, File: sf.File, f: sf}, nil
+}
+
+// unwrap the share with its holder's credentials, solving its puzzles
+func (s *Share) Open(unlock Unlock) error {
+	if !unlock.fits(s.f.Slot) {
+		return fmt.Errorf("share %d (%s) needs its holder's password or identity", s.Index, s.Label)
+	}
+	value, err := unwrapKey(unlock, s.f.Slot)
+	if err != nil {
+		return fmt.Errorf("share %d: %w", s.Index, err)
+	}
+	s.value.Wipe()
+	s.value = value
+	return nil
+}
+
+// wipe the unwrapped share
+func (s *Share) Wipe() {
+	s.value.Wipe()
+}
+
+// recover the data key from opened shares of one split, the caller wipes it
+// the key is checked so a wrong combination is an error and not a wrong key
+func CombineShares(shares []*Share) (*secret.Secret, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no shares given")
+	}
+	first := shares[0].f
+	var values [][]byte
+	for _, s := range shares {
+		if s.f.ID != first.ID {
+			return nil, fmt.Errorf("share %d (%s) is from a different split", s.Index, s.Label)
+		}
+		if s.value.Empty() {
+			return nil, fmt.Errorf("share %d (%s) is not opened", s.Index, s.Label)
+		}
+		values = append(values, s.value.Bytes())
+	}
+	if len(shares) < first.Threshold {
+		return nil, fmt.Errorf("%d of the %d shares needed are given", len(shares), first.Threshold)
+	}
+	id, err := base64.StdEncoding.DecodeString(first.ID)
+	if err != nil {
+		return nil, fmt.Errorf("decoding share id: %v", err)
+	}
+	combined, err := shamir.Combine(values)
+	if err != nil {
+		return nil, err
+	}
+	key := secret.New(combined)
+	if subtle.ConstantTimeCompare([]byte(shareCheck(key, id)), []byte(first.Check)) != 1 {
+		key.Wipe()
+		return nil, fmt.Errorf("the shares don't combine into the data key (%w)", ErrTampered)
+	}
+	return key, nil
+}
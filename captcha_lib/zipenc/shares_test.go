@@ -0,0 +1,46 @@
+package zipenc
+
+import (
+	"captcha/captcha_lib/secret"
+	"captcha/captcha_lib/shamir"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// opened shares of a split of key into n with a threshold of k, as read from their files
+func openedShares(t *testing.T, key *secret.Secret, n int, k int) []*Share {
+	t.Helper()
+	values, err := shamir.Split(key.Bytes(), n, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := []byte("a split of a key")
+	var shares []*Share
+	for i, v := range values {
+		f := shareFile{Type: shareType, ID: base64.StdEncoding.EncodeToString(id), Threshold: k, Shares: n, Index: i + 1, Check: shareCheck(key, id)}
+		shares = append(shares, &Share{Index: i + 1, Threshold: k, Shares: n, f: f, value: secret.New(v)})
+	}
+	return shares
+}
+
+// a changed share is told by the check and not taken for the data key
+func TestCombineSharesTampered(t *testing.T) {
+	key := secret.New([]byte("0123456789abcdef0123456789abcdef"))
+	shares := openedShares(t, key, 3, 2)
+	combined, err := CombineShares(shares[:2])
+	if err != nil {
+		t.Fatalf("combining: %v", err)
+	}
+	if !combined.Equal(key.Bytes()) {
+		t.Fatal("the shares combine into a different key")
+	}
+
+	shares[1].value.Bytes()[5] ^= 1
+	if _, err := CombineShares(shares[:2]); !errors.Is(err, ErrTampered) {
+		t.Errorf("combined a tampered share: %v", err)
+	}
+	if _, err := CombineShares(shares[:1]); err == nil {
+		t.Error("combined fewer shares than the threshold")
+	}
+}
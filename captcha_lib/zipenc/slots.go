@@ -0,0 +1,381 @@
+package zipenc
+
+import (
+	"bytes"
+	"captcha/captcha_lib/chess"
+	"captcha/captcha_lib/hashpuzzle"
+	"captcha/captcha_lib/secret"
+	"captcha/captcha_lib/strength"
+	"captcha/captcha_lib/sudoku"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// a key slot wraps the data key under one unlock path (password + puzzles)
+// slots work like LUKS key slots, any one of them can open the file and
+// they can be added or removed without re-encrypting the payload
+type KeySlot struct {
+	// "" for a password slot, "x25519" for a slot wrapped to a public key
+	Type         string `json:"Type,omitempty"`
+	Label        string `json:"Label"`
+	N            uint16 `json:"N"`
+	Salt         string `json:"Salt"`
+	Chess        bool   `json:"Chess"`
+	HashPuzzle   bool   `json:"Hash"`
+	SudokuPuzzle bool   `json:"Sudoku"`
+	// the chess puzzles skipped before each accepted one, replayed to present the same puzzles
+	ChessSkips []int `json:"Offsets"`
+	// the settings the chess puzzles were made with, nil for the defaults
+	ChessOptions *chess.ChessOptions `json:"ChessOptions,omitempty"`
+	// where the chess puzzles were drawn from, only in slots written before ChessOptions
+	ChessSource *chess.PuzzleSource `json:"ChessSource,omitempty"`
+	// the data key sealed under the slot key (nonce prefixed, base64)
+	Key string `json:"Key"`
+	// x25519 slots only: the recipient and the ephemeral public key
+	Recipient string `json:"Recipient,omitempty"`
+	Ephemeral string `json:"Ephemeral,omitempty"`
+}
+
+// the description of a slot to create
+// Puzzles selects the sudoku, chess and hashpuzzle puzzles (in that order) the slot is gated on
+// PuzzleKey holds the keys of those puzzles in the same order, nil for the puzzles not selected
+// ChessSkips are the chess puzzles skipped while the chess key was made
+// when Recipient is set the slot is wrapped to that public key instead of a password
+// and the recipient has to solve the puzzles selected, PuzzleKey is unused
+// ChessOptions are the settings the chess puzzles were made with (nil for the defaults)
+// the secrets stay owned by the caller, who wipes them
+type SlotSpec struct {
+	Label        string
+	Key          *secret.Secret
+	PuzzleKey    [3]*secret.Secret
+	ChessSkips   []int
+	Recipient    *ecdh.PublicKey
+	Puzzles      [3]bool
+	ChessOptions *chess.ChessOptions
+}
+
+// the credentials offered to open a file
+// the password and data key stay owned by the caller, who wipes them
+type Unlock struct {
+	Key *secret.Secret
+	// the key slot to unlock, -1 tries each slot the credentials fit
+	Slot       int
+	Identities []*ecdh.PrivateKey
+	// a data key recovered without a slot (from combined shares), used instead of the slots
+	DataKey *secret.Secret
+}
+
+// the policy password slots have to meet, it can be replaced by callers
+var PasswordPolicy = strength.DefaultPolicy
+
+// create the slot described by spec
+func newSlot(key *secret.Secret, spec SlotSpec, N uint16) (KeySlot, error) {
+	if spec.Recipient != nil {
+		return wrapKeyRecipient(key, spec, N)
+	}
+	return wrapKey(key, spec, N)
+}
+
+// check the password of every password slot against PasswordPolicy
+// recipient slots are keyed by a random X25519 secret and need no check
+func checkPolicy(specs []SlotSpec, N uint16) error {
+	for _, spec := range specs {
+		if spec.Recipient != nil {
+			continue
+		}
+		if err := PasswordPolicy.Check(spec.Key.Bytes(), N); err != nil {
+			return fmt.Errorf("slot %q: %v", spec.Label, err)
+		}
+	}
+	return nil
+}
+
+// the puzzles of SlotSpec.Puzzles and PuzzleKey
+var puzzleNames = [3]string{"sudoku", "chess", "hashpuzzle"}
+
+// wrap the data key under the key derived from the slot password and puzzle keys
+// a puzzle selected without a key (e.g. one left unsolved) is an error, not an ungated slot
+func wrapKey(key *secret.Secret, spec SlotSpec, N uint16) (KeySlot, error) {
+	var slot KeySlot
+	for i, gated := range spec.Puzzles {
+		if gated && spec.PuzzleKey[i].Empty() {
+			return slot, fmt.Errorf("slot %q: the %s puzzle key is empty", spec.Label, puzzleNames[i])
+		}
+		if !gated && !spec.PuzzleKey[i].Empty() {
+			return slot, fmt.Errorf("slot %q: a %s puzzle key is given but the puzzle isn't selected", spec.Label, puzzleNames[i])
+		}
+	}
+	salt := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return slot, err
+	}
+	slot.Label = spec.Label
+	slot.N = N
+	slot.Salt = base64.StdEncoding.EncodeToString(salt)
+	slot.SudokuPuzzle = spec.Puzzles[0]
+	slot.Chess = spec.Puzzles[1]
+	slot.HashPuzzle = spec.Puzzles[2]
+	if slot.Chess {
+		slot.ChessSkips = spec.ChessSkips
+		slot.ChessOptions = spec.ChessOptions
+	}
+
+	kek := deriveKek(secret.Concat(spec.Key, spec.PuzzleKey[0], spec.PuzzleKey[1], spec.PuzzleKey[2]), N, salt)
+	defer kek.Wipe()
+	wrapped, err := seal(kek.Bytes(), key.Bytes())
+	if err != nil {
+		return slot, err
+	}
+	slot.Key = base64.StdEncoding.EncodeToString(wrapped)
+	return slot, nil
+}
+
+// hash the password and puzzle keys in material into a key encryption key
+// material is wiped
+func deriveKek(material *secret.Secret, N uint16, salt []byte) *secret.Secret {
+	defer material.Wipe()
+	return secret.New(HashNb(material.Bytes(), N, salt))
+}
+
+// solve the puzzles the slot is gated on and return the password followed by the puzzle keys
+func slotPuzzleKey(key *secret.Secret, slot KeySlot) (*secret.Secret, error) {
+	var PuzzleKey [3]*secret.Secret
+	defer wipeAll(PuzzleKey[:])
+	if slot.SudokuPuzzle {
+		PuzzleKey[0] = sudoku.GetPuzzleKey(key, slot.N)
+	}
+	if slot.Chess {
+		var err error
+		// the skips are replayed, slots solved without asking record none
+		skips := slot.ChessSkips
+		if skips == nil {
+			skips = []int{}
+		}
+		PuzzleKey[1], _, err = chess.GetPuzzleKey(key, slot.ChessSettings(), skips)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if slot.HashPuzzle {
+		PuzzleKey[2] = hashpuzzle.GenerateHashKey(key)
+	}
+	return secret.Concat(key, PuzzleKey[0], PuzzleKey[1], PuzzleKey[2]), nil
+}
+
+// the settings of the chess puzzles of slot, reading the puzzle source of slots written before ChessOptions
+func (slot KeySlot) ChessSettings() *chess.ChessOptions {
+	if slot.ChessOptions == nil && slot.ChessSource != nil {
+		return &chess.ChessOptions{Source: slot.ChessSource}
+	}
+	return slot.ChessOptions
+}
+
+// wipe every secret in keys
+func wipeAll(keys []*secret.Secret) {
+	for _, k := range keys {
+		k.Wipe()
+	}
+}
+
+// recover the data key from a single slot
+func unwrapKey(u Unlock, slot KeySlot) (*secret.Secret, error) {
+	key := u.Key
+	if slot.Type == slotX25519 {
+		seed, err := recipientSlotSecret(slot, u.Identities)
+		if err != nil {
+			return nil, err
+		}
+		defer seed.Wipe()
+		key = seed
+	}
+	salt, err := base64.StdEncoding.DecodeString(slot.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("decoding salt: %v", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(slot.Key)
+	if err != nil {
+		return nil, fmt.Errorf("decoding wrapped key: %v", err)
+	}
+	material, err := slotPuzzleKey(key, slot)
+	if err != nil {
+		return nil, err
+	}
+	kek := deriveKek(material, slot.N, salt)
+	defer kek.Wipe()
+	dataKey, err := open(kek.Bytes(), wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w or puzzle solution for slot %q", ErrWrongKey, slot.Label)
+	}
+	return secret.New(dataKey), nil
+}
+
+// whether the credentials can be tried against a slot without a wasted puzzle
+func (u Unlock) fits(slot KeySlot) bool {
+	if slot.Type == slotX25519 {
+		_, err := recipientSlotSecret(slot, u.Identities)
+		return err == nil
+	}
+	return !u.Key.Empty()
+}
+
+// recover the key that encrypts the payload, the caller wipes it
+// u.Slot selects a key slot, -1 tries each slot the credentials fit in order
+func unlockKey(u Unlock, header ContextHeaderStruct) (*secret.Secret, error) {
+	key, _, err := unlockSlot(u, header)
+	return key, err
+}
+
+// same as unlockKey but also returns the index of the slot that opened
+// (-1 for a file written before key slots existed or opened with a data key)
+func unlockSlot(u Unlock, header ContextHeaderStruct) (*secret.Secret, int, error) {
+	if !u.DataKey.Empty() {
+		return u.DataKey.Clone(), -1, nil
+	}
+	if len(header.Slots) == 0 {
+		key, err := legacyKey(u.Key, header)
+		return key, -1, err
+	}
+	if u.Slot >= len(header.Slots) {
+		return nil, 0, fmt.Errorf("no key slot %d (file has %d)", u.Slot, len(header.Slots))
+	}
+	if u.Slot >= 0 {
+		key, err := unwrapKey(u, header.Slots[u.Slot])
+		return key, u.Slot, err
+	}
+	for i, s := range header.Slots {
+		if !u.fits(s) {
+			continue
+		}
+		fmt.Printf("trying key slot %d (%s)\n", i, s.Label)
+		key, err := unwrapKey(u, s)
+		if err == nil {
+			return key, i, nil
+		}
+		fmt.Println(err)
+	}
+	return nil, 0, fmt.Errorf("no key slot could be unlocked (%w)", ErrWrongKey)
+}
+
+// read an encrypted file and split it into its header and payload
+func readContainer(file string) (ContextHeaderStruct, []byte, error) {
+	if err := manifestError(file); err != nil {
+		return ContextHeaderStruct{}, nil, err
+	}
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return ContextHeaderStruct{}, nil, err
+	}
+	// the parity is not part of the payload
+	text = text[:containerSize(bytes.NewReader(text), int64(len(text)))]
+	return parseHeader(text)
+}
+
+// read only the header of file
+// returns the header and the offset its payload starts at
+func readHeader(file string) (ContextHeaderStruct, int64, error) {
+	var header ContextHeaderStruct
+	if err := manifestError(file); err != nil {
+		return header, 0, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return header, 0, err
+	}
+	defer f.Close()
+	return decodeHeader(f)
+}
+
+// read only the header at the start of r
+// returns the header and the offset its payload starts at
+func decodeHeader(r io.Reader) (ContextHeaderStruct, int64, error) {
+	var header ContextHeaderStruct
+	dec := json.NewDecoder(r)
+	err := dec.Decode(&header)
+	if err != nil {
+		return header, 0, headerError(err)
+	}
+	return header, dec.InputOffset(), nil
+}
+
+// write a header and an untouched payload back to file
+// the old file stays in place until the new one is complete
+func writeContainer(file string, header ContextHeaderStruct, payload []byte) error {
+	if header.Format != FormatEntries {
+		header.Size = int64(len(payload))
+	}
+	headerB, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(file, 0644, func(f *os.File) error {
+		_, err := f.Write(headerB)
+		if err == nil {
+			_, err = f.Write(payload)
+		}
+		if err != nil {
+			return err
+		}
+		return appendParity(f, header.Parity)
+	})
+}
+
+// list the key slots of an encrypted file
+func ListSlots(file string) ([]KeySlot, error) {
+	header, _, err := readContainer(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Slots) == 0 {
+		return nil, fmt.Errorf("%s has no key slots (created before slots were supported)", file)
+	}
+	return header.Slots, nil
+}
+
+// add a key slot to file
+// the data key is first recovered from an existing slot with the unlock credentials
+func AddSlot(unlock Unlock, spec SlotSpec, N uint16, file string) error {
+	header, payload, err := readContainer(file)
+	if err != nil {
+		return err
+	}
+	if len(header.Slots) == 0 {
+		return fmt.Errorf("%s has no key slots (created before slots were supported)", file)
+	}
+	if err := checkPolicy([]SlotSpec{spec}, N); err != nil {
+		return err
+	}
+	key, err := unlockKey(unlock, header)
+	if err != nil {
+		return err
+	}
+	defer key.Wipe()
+	slot, err := newSlot(key, spec, N)
+	if err != nil {
+		return err
+	}
+	header.Slots = append(header.Slots, slot)
+	return writeContainer(file, header, payload)
+}
+
+// remove key slot index from file
+// the last remaining slot cannot be removed as the file could never be opened again
+func RemoveSlot(index int, file string) error {
+	header, payload, err := readContainer(file)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(header.Slots) {
+		return fmt.Errorf("no key slot %d (file has %d)", index, len(header.Slots))
+	}
+	if len(header.Slots) == 1 {
+		return fmt.Errorf("refusing to remove the only key slot")
+	}
+	header.Slots = append(header.Slots[:index], header.Slots[index+1:]...)
+	return writeContainer(file, header, payload)
+}
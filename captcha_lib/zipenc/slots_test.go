@@ -0,0 +1,31 @@
+package zipenc
+
+import (
+	"captcha/captcha_lib/secret"
+	"testing"
+)
+
+// the puzzles of a slot come from SlotSpec.Puzzles, a key missing for one is an error
+func TestWrapKeyPuzzles(t *testing.T) {
+	key := secret.New(make([]byte, 32))
+	password := secret.New([]byte(testPassword))
+	hashKey := secret.New([]byte("the hashpuzzle key"))
+
+	slot, err := wrapKey(key, SlotSpec{Label: "gated", Key: password, Puzzles: [3]bool{false, false, true}, PuzzleKey: [3]*secret.Secret{nil, nil, hashKey}}, 10)
+	if err != nil {
+		t.Fatalf("wrapping a gated slot: %v", err)
+	}
+	if slot.SudokuPuzzle || slot.Chess || !slot.HashPuzzle {
+		t.Errorf("slot gated on sudoku %v, chess %v, hashpuzzle %v, want hashpuzzle only", slot.SudokuPuzzle, slot.Chess, slot.HashPuzzle)
+	}
+
+	// a puzzle left unsolved must not leave the slot ungated
+	_, err = wrapKey(key, SlotSpec{Label: "unsolved", Key: password, Puzzles: [3]bool{false, false, true}, PuzzleKey: [3]*secret.Secret{nil, nil, secret.New(nil)}}, 10)
+	if err == nil {
+		t.Error("wrapped a slot whose selected puzzle key is empty")
+	}
+	_, err = wrapKey(key, SlotSpec{Label: "unselected", Key: password, PuzzleKey: [3]*secret.Secret{nil, nil, hashKey}}, 10)
+	if err == nil {
+		t.Error("wrapped a slot with a key for a puzzle not selected")
+	}
+}
@@ -0,0 +1,215 @@
+package zipenc
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// prefix of the PAX records holding extended attributes (as GNU tar and bsdtar use)
+const paxXattr = "SCHILY.xattr."
+
+// tar infile (a file or folder) into w, compressing the whole stream
+func tarFile(infile string, w io.Writer, compression string) error {
+	cw, err := compressWriter(w, compression)
+	if err != nil {
+		return err
+	}
+	writer := tar.NewWriter(cw)
+	err = tarAdd(writer, infile, "")
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// write infile (a file or folder) to writer, named below the archive folder prefix ("" for the top)
+func tarAdd(writer *tar.Writer, infile string, prefix string) error {
+	// Walk uses Lstat so symlinks are visited as links and not followed
+	return filepath.Walk(infile, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the header keeps the mode, times, owner and owner names
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Format = tar.FormatPAX
+		header.Name, err = entryName(infile, path, prefix, info.IsDir())
+		if err != nil {
+			return err
+		}
+		if !PreserveOwner {
+			header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		}
+		if PreserveXattrs {
+			attrs, err := listXattrs(path)
+			if err == nil {
+				for name, value := range attrs {
+					if header.PAXRecords == nil {
+						header.PAXRecords = make(map[string]string)
+					}
+					header.PAXRecords[paxXattr+name] = string(value)
+				}
+			}
+		}
+
+		err = writer.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(writer, f)
+		return err
+	})
+}
+
+// the metadata of a tar entry
+func tarMeta(header *tar.Header) entryMeta {
+	meta := entryMeta{
+		Mode:     header.FileInfo().Mode(),
+		Modified: header.ModTime,
+		HasOwner: header.Uname != "" || header.Uid != 0 || header.Gid != 0,
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+	}
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, paxXattr) {
+			if meta.Xattrs == nil {
+				meta.Xattrs = make(map[string][]byte)
+			}
+			meta.Xattrs[strings.TrimPrefix(key, paxXattr)] = []byte(value)
+		}
+	}
+	return meta
+}
+
+// extract the compressed tar stream of the given size read from in into the folder outfile
+// only the entries at or below paths are extracted, every entry when paths is empty
+// entries are checked against ExtractionPolicy
+func untarFile(in io.Reader, size int64, outfile string, compression string, paths []string) error {
+	r, err := decompressReader(in, compression)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	reader := tar.NewReader(r)
+
+	err = os.MkdirAll(outfile, 0755)
+	if err != nil {
+		return err
+	}
+	e := newExtraction(outfile)
+	e.choose(paths)
+	if compression != CompressNone {
+		e.stream = size
+	}
+
+	// directories get their permissions and times once everything inside them is written
+	type dirEntry struct {
+		path string
+		meta entryMeta
+	}
+	var dirs []dirEntry
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !e.wanted(header.Name) {
+			continue
+		}
+
+		path, err := e.entry(header.Name)
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeDir {
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				return err
+			}
+		}
+
+		meta := tarMeta(header)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, dirEntry{path, meta})
+		case tar.TypeSymlink:
+			err = extractSymlink(e, strings.NewReader(header.Linkname), header.Name, path, meta)
+			if err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, meta.Mode.Perm())
+			if err != nil {
+				return err
+			}
+			// the stream is compressed as a whole, only the total size is limited
+			err = e.copy(out, reader, header.Name, 0)
+			if err == nil {
+				err = out.Sync()
+			}
+			if err != nil {
+				out.Close()
+				return err
+			}
+			err = out.Close()
+			if err != nil {
+				return err
+			}
+			err = restoreMetadata(path, meta)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported tar entry %s (type %c)", header.Name, header.Typeflag)
+		}
+	}
+	if err := e.missing(); err != nil {
+		return err
+	}
+
+	// deepest directories first so restoring a child doesn't change its parent again
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := restoreMetadata(dirs[i].path, dirs[i].meta)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
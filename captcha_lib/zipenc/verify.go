@@ -0,0 +1,245 @@
+package zipenc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"captcha/captcha_lib/secret"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/***
+
+checking an encrypted file without extracting it
+
+the file is unlocked, every sealed chunk is authenticated and the archive
+inside is read through to its end so the zip, gzip, zstd and xz checksums
+are checked. nothing is written to disk, the content is discarded as it is read
+
+***/
+
+// why a file failed to open, the errors returned wrap one of these
+var (
+	// no key slot opens with the credentials given
+	ErrWrongKey = errors.New("wrong key")
+	// the data key is right but the ciphertext fails to authenticate
+	ErrTampered = errors.New("ciphertext has been modified")
+	// the file ends early
+	ErrTruncated = errors.New("file is truncated")
+	// the ciphertext authenticates but the archive inside it doesn't read back
+	ErrCorrupt = errors.New("archive is corrupt")
+)
+
+// what a verification checked
+type VerifyResult struct {
+	Format      string
+	Compression string
+	// the number of entries (1 for FormatRaw)
+	Entries int
+	// the number of bytes the archive expands to
+	Size int64
+}
+
+// an error reading the header, a header cut short means the file is truncated
+func headerError(err error) error {
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("unmarshalling header: %w", ErrTruncated)
+	}
+	return fmt.Errorf("unmarshalling header: %v (%w)", err, ErrCorrupt)
+}
+
+// compare a sealed payload with the length recorded in the header
+// files written before the length was recorded can't tell truncation from modification
+func checkLength(header ContextHeaderStruct, payload []byte) error {
+	if header.Size > 0 && int64(len(payload)) < header.Size {
+		return fmt.Errorf("payload has %d of %d bytes: %w", len(payload), header.Size, ErrTruncated)
+	}
+	if header.Size > 0 && int64(len(payload)) > header.Size {
+		return fmt.Errorf("payload has %d bytes more than written: %w", int64(len(payload))-header.Size, ErrTampered)
+	}
+	// the shortest payload is a nonce and a tag
+	if len(payload) < 12+16 {
+		return fmt.Errorf("payload has %d bytes: %w", len(payload), ErrTruncated)
+	}
+	return nil
+}
+
+// mark err as a sign of a corrupt archive unless it already tells what is wrong
+func corrupt(err error) error {
+	if err == nil || errors.Is(err, ErrWrongKey) || errors.Is(err, ErrTampered) || errors.Is(err, ErrTruncated) || errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	return fmt.Errorf("%v (%w)", err, ErrCorrupt)
+}
+
+// unlock file (or join the volumes of a manifest), authenticate its ciphertext and read its archive through without writing anything
+// the error wraps ErrWrongKey, ErrTampered, ErrTruncated or ErrCorrupt when the file is at fault
+func Verify(unlock Unlock, file string) (VerifyResult, error) {
+	m, ok, err := readManifest(file)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	if ok {
+		// the joined volumes are checked where they are, in memory
+		container, err := joinVolumes(unlock, file, m)
+		if err != nil {
+			return VerifyResult{}, err
+		}
+		return verifyContainer(unlock, bytes.NewReader(container), int64(len(container)))
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	return verifyContainer(unlock, f, info.Size())
+}
+
+// verify the container of size bytes read from r
+func verifyContainer(unlock Unlock, r io.ReaderAt, size int64) (VerifyResult, error) {
+	var result VerifyResult
+	header, payload, err := payloadSection(r, size)
+	if err != nil {
+		return result, err
+	}
+	opts := header.archive()
+	result.Format, result.Compression = opts.Format, opts.Compression
+	// the size and ratio limits of extraction apply, there is no folder to write to
+	e := newExtraction("")
+
+	if opts.Format == FormatEntries {
+		ef, err := unlockEntries(unlock, header, payload)
+		if err != nil {
+			return result, err
+		}
+		defer ef.Close()
+		for _, x := range ef.entries {
+			result.Entries++
+			if !x.Mode.IsRegular() {
+				continue
+			}
+			err = ef.verifyFile(e, x)
+			if err != nil {
+				return result, corrupt(err)
+			}
+		}
+		result.Size = e.total
+		return result, nil
+	}
+
+	cipherText := make([]byte, payload.Size())
+	_, err = payload.ReadAt(cipherText, 0)
+	if err != nil {
+		return result, err
+	}
+	plainText, err := decryptPayload(unlock, header, cipherText)
+	if err != nil {
+		return result, err
+	}
+	defer secret.Wipe(plainText)
+
+	switch opts.Format {
+	case FormatZip:
+		result.Entries, err = verifyZip(e, plainText)
+	case FormatTar:
+		result.Entries, err = verifyTar(e, plainText, opts.Compression)
+	case FormatRaw:
+		result.Entries, err = 1, verifyRaw(e, plainText, opts.Compression)
+	default:
+		err = fmt.Errorf("unknown archive format %q", opts.Format)
+	}
+	result.Size = e.total
+	return result, corrupt(err)
+}
+
+// read every entry of a zip archive, archive/zip checks the CRC of each one
+func verifyZip(e *extraction, data []byte) (int, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	r.RegisterDecompressor(zipMethodZstd, func(r io.Reader) io.ReadCloser { return decompressOrFail(r, CompressZstd) })
+	r.RegisterDecompressor(zipMethodXz, func(r io.Reader) io.ReadCloser { return decompressOrFail(r, CompressXz) })
+
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return 0, fmt.Errorf("entry %s: %v", f.Name, err)
+		}
+		err = e.copy(io.Discard, rc, f.Name, int64(f.CompressedSize64))
+		rc.Close()
+		if err != nil {
+			return 0, fmt.Errorf("entry %s: %v", f.Name, err)
+		}
+	}
+	return len(r.File), nil
+}
+
+// read a compressed tar stream to its end, the compressor checks its checksum
+func verifyTar(e *extraction, data []byte, compression string) (int, error) {
+	r, err := decompressReader(bytes.NewReader(data), compression)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	if compression != CompressNone {
+		e.stream = int64(len(data))
+	}
+	reader := tar.NewReader(r)
+	entries := 0
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries++
+		err = e.copy(io.Discard, reader, header.Name, 0)
+		if err != nil {
+			return entries, fmt.Errorf("entry %s: %v", header.Name, err)
+		}
+	}
+	// anything after the end of the archive is read so the compressor reaches its checksum
+	_, err = io.Copy(io.Discard, r)
+	return entries, err
+}
+
+// decompress a raw file to its end
+func verifyRaw(e *extraction, data []byte, compression string) error {
+	r, err := decompressReader(bytes.NewReader(data), compression)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if compression != CompressNone {
+		e.stream = int64(len(data))
+	}
+	return e.copy(io.Discard, r, "", 0)
+}
+
+// decrypt and decompress entry x, checking it expands to the size in the index
+func (ef *entryFile) verifyFile(e *extraction, x indexEntry) error {
+	rc, err := ef.open(x)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	before := e.total
+	err = e.copy(io.Discard, rc, x.Name, x.Length)
+	if err != nil {
+		return err
+	}
+	if e.total-before != x.Size {
+		return fmt.Errorf("entry %s holds %d bytes, the index says %d (%w)", x.Name, e.total-before, x.Size, ErrCorrupt)
+	}
+	return nil
+}
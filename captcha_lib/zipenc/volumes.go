@@ -0,0 +1,302 @@
+package zipenc
+
+import (
+	"bytes"
+	"captcha/captcha_lib/chess"
+	"captcha/captcha_lib/secret"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+/***
+
+split volumes
+
+an encrypted file can be cut into volumes of a fixed size for channels that
+limit the size of a file. the file itself becomes a manifest listing the
+volumes (file.001, file.002, ...) with their length and SHA256, and the
+SHA256 of the whole container they join into
+
+a volume can be gated on puzzles of its own. a gated volume is sealed under
+a random volume key which is wrapped into a key slot in the manifest. the
+slot is keyed by a secret derived from the password, the manifest id and
+the volume number, so every gated volume asks for different puzzles even
+when they are of the same kind
+
+the volumes hold the container as it is, joining them gives back the file
+that was split and its own key slots, authentication and parity still apply
+
+***/
+
+// marks a manifest
+const manifestType = "captcha-volumes"
+
+// the manifest that replaces a file split into volumes
+type volumeManifest struct {
+	Type string `json:"Type"`
+	// random, keys the gates of this split
+	ID string `json:"ID"`
+	// the length and SHA256 of the container the volumes join into
+	Size    int64          `json:"Size"`
+	Hash    string         `json:"Hash"`
+	Volumes []volumeRecord `json:"Volumes"`
+}
+
+// one volume, its name is relative to the folder of the manifest
+type volumeRecord struct {
+	Name string `json:"Name"`
+	Size int64  `json:"Size"`
+	Hash string `json:"Hash"`
+	// set when the volume is gated, the slot wraps the volume key
+	Gate *KeySlot `json:"Gate,omitempty"`
+}
+
+// a volume (numbered from 1) to gate on puzzles (sudoku, chess, hashpuzzle order)
+// the chess puzzles are made with ChessOptions (the defaults when nil)
+type VolumeGate struct {
+	Volume       int
+	Puzzles      [3]bool
+	ChessOptions *chess.ChessOptions
+}
+
+// the name of volume i (from 0) of file
+func volumeName(file string, i int) string {
+	return fmt.Sprintf("%s.%03d", filepath.Base(file), i+1)
+}
+
+// the secret a volume gate is keyed by, derived from the password
+func volumeSecret(key *secret.Secret, id []byte, volume int) *secret.Secret {
+	okm := hkdfKey(key.Bytes(), id, "captcha-volume-"+strconv.Itoa(volume))
+	defer secret.Wipe(okm)
+	return secret.Hex(okm)
+}
+
+// read the manifest in file, false when file is not a manifest
+func readManifest(file string) (volumeManifest, bool, error) {
+	var m volumeManifest
+	f, err := os.Open(file)
+	if err != nil {
+		return m, false, err
+	}
+	defer f.Close()
+	// only the first json value is decoded, a container carries its payload after it
+	if json.NewDecoder(f).Decode(&m) != nil || m.Type != manifestType {
+		return m, false, nil
+	}
+	return m, true, nil
+}
+
+// whether file is a manifest of split volumes
+func IsManifest(file string) bool {
+	_, ok, _ := readManifest(file)
+	return ok
+}
+
+// whether file is a manifest with volumes gated on puzzles
+func HasGatedVolumes(file string) bool {
+	m, ok, _ := readManifest(file)
+	if !ok {
+		return false
+	}
+	for _, v := range m.Volumes {
+		if v.Gate != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// the error for a manifest given where a container is needed
+func manifestError(file string) error {
+	if IsManifest(file) {
+		return fmt.Errorf("%s is a volume manifest, join its volumes first", file)
+	}
+	return nil
+}
+
+// split the encrypted file into volumes of at most size bytes next to it
+// and replace file with their manifest. gates are solved here, keyed by the
+// password key, so the decryptor has to solve them to get the volume back
+// returns the names of the volumes
+func SplitVolumes(file string, size int64, key *secret.Secret, gates []VolumeGate, N uint16) ([]string, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("volume size %d is not positive", size)
+	}
+	container, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok, _ := readManifest(file); ok {
+		return nil, fmt.Errorf("%s is already split into volumes", file)
+	}
+	count := int((int64(len(container)) + size - 1) / size)
+	gated := make(map[int]VolumeGate)
+	for _, g := range gates {
+		if g.Volume < 1 || g.Volume > count {
+			return nil, fmt.Errorf("no volume %d to gate (%s splits into %d)", g.Volume, file, count)
+		}
+		if g.Puzzles != [3]bool{} {
+			gated[g.Volume-1] = g
+		}
+	}
+	if len(gated) > 0 && key.Empty() {
+		return nil, fmt.Errorf("gating volumes on puzzles needs a password")
+	}
+
+	id := make([]byte, 16)
+	_, err = io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(container)
+	m := volumeManifest{
+		Type: manifestType,
+		ID:   base64.StdEncoding.EncodeToString(id),
+		Size: int64(len(container)),
+		Hash: hex.EncodeToString(sum[:]),
+	}
+
+	var names []string
+	dir := filepath.Dir(file)
+	for i := 0; i < count; i++ {
+		data := container[int64(i)*size : min(int64(len(container)), int64(i+1)*size)]
+		v := volumeRecord{Name: volumeName(file, i)}
+		if g, ok := gated[i]; ok {
+			v.Gate, data, err = gateVolume(data, key, id, g, N)
+			if err != nil {
+				return nil, fmt.Errorf("volume %d: %v", i+1, err)
+			}
+		}
+		vsum := sha256.Sum256(data)
+		v.Size, v.Hash = int64(len(data)), hex.EncodeToString(vsum[:])
+		err = writeFileAtomic(filepath.Join(dir, v.Name), data, 0644)
+		if err != nil {
+			return nil, err
+		}
+		m.Volumes = append(m.Volumes, v)
+		names = append(names, filepath.Join(dir, v.Name))
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return names, writeFileAtomic(file, append(manifest, '\n'), 0644)
+}
+
+// seal data under a random volume key wrapped into a slot gated on puzzles
+func gateVolume(data []byte, key *secret.Secret, id []byte, gate VolumeGate, N uint16) (*KeySlot, []byte, error) {
+	volumeKey := secret.New(make([]byte, 32))
+	defer volumeKey.Wipe()
+	_, err := io.ReadFull(rand.Reader, volumeKey.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("volume key: %v", err)
+	}
+	seed := volumeSecret(key, id, gate.Volume)
+	defer seed.Wipe()
+	PuzzleKey, err := solvePuzzleKeys(seed, gate.Puzzles, gate.ChessOptions, N)
+	defer wipeAll(PuzzleKey[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slot, err := wrapKey(volumeKey, SlotSpec{Label: "volume " + strconv.Itoa(gate.Volume), Key: seed, Puzzles: gate.Puzzles, PuzzleKey: PuzzleKey, ChessOptions: gate.ChessOptions}, N)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, err := seal(volumeKey.Bytes(), data)
+	return &slot, sealed, err
+}
+
+// read the volumes of manifest, solve their gates and join them into outfile
+// the error wraps ErrTruncated for a missing or short volume, ErrWrongKey
+// for a gate that doesn't open and ErrTampered for a modified volume
+func JoinVolumes(unlock Unlock, manifest string, outfile string) error {
+	m, ok, err := readManifest(manifest)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is not a volume manifest", manifest)
+	}
+	container, err := joinVolumes(unlock, manifest, m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(outfile, container, 0644)
+}
+
+// read and check every volume of m and return the container they join into
+func joinVolumes(unlock Unlock, manifest string, m volumeManifest) ([]byte, error) {
+	id, err := base64.StdEncoding.DecodeString(m.ID)
+	if err != nil {
+		return nil, fmt.Errorf("decoding manifest id: %v", err)
+	}
+	// every volume is checked before any puzzle is asked for
+	dir := filepath.Dir(manifest)
+	volumes := make([][]byte, len(m.Volumes))
+	for i, v := range m.Volumes {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.Base(v.Name)))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("volume %d (%s) is missing: %w", i+1, v.Name, ErrTruncated)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) < v.Size {
+			return nil, fmt.Errorf("volume %d (%s) has %d of %d bytes: %w", i+1, v.Name, len(data), v.Size, ErrTruncated)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != v.Size || hex.EncodeToString(sum[:]) != v.Hash {
+			return nil, fmt.Errorf("volume %d (%s) doesn't match the manifest: %w", i+1, v.Name, ErrTampered)
+		}
+		volumes[i] = data
+	}
+
+	var container bytes.Buffer
+	for i, v := range m.Volumes {
+		data := volumes[i]
+		if v.Gate != nil {
+			data, err = openVolume(unlock, id, i+1, *v.Gate, data)
+			if err != nil {
+				return nil, fmt.Errorf("volume %d (%s): %w", i+1, v.Name, err)
+			}
+		}
+		container.Write(data)
+	}
+	sum := sha256.Sum256(container.Bytes())
+	if int64(container.Len()) != m.Size || hex.EncodeToString(sum[:]) != m.Hash {
+		return nil, fmt.Errorf("the volumes don't join into the file they were split from: %w", ErrTampered)
+	}
+	return container.Bytes(), nil
+}
+
+// solve the gate of a volume and open it
+func openVolume(unlock Unlock, id []byte, volume int, gate KeySlot, data []byte) ([]byte, error) {
+	if unlock.Key.Empty() {
+		return nil, fmt.Errorf("the volume is gated on a password (%w)", ErrWrongKey)
+	}
+	fmt.Printf("volume %d is gated on puzzles of its own\n", volume)
+	seed := volumeSecret(unlock.Key, id, volume)
+	defer seed.Wipe()
+	volumeKey, err := unwrapKey(Unlock{Key: seed}, gate)
+	if err != nil {
+		return nil, err
+	}
+	defer volumeKey.Wipe()
+	data, err = open(volumeKey.Bytes(), data)
+	if err != nil {
+		return nil, fmt.Errorf("opening volume: %w", ErrTampered)
+	}
+	return data, nil
+}
@@ -0,0 +1,43 @@
+package zipenc
+
+import (
+	"captcha/captcha_lib/secret"
+	"path/filepath"
+	"testing"
+)
+
+// verifying and decrypting split volumes joins them in memory, with nowhere to write a temporary file
+func TestVolumesInMemory(t *testing.T) {
+	for _, format := range []string{FormatZip, FormatEntries} {
+		t.Run(format, func(t *testing.T) {
+			root := makeTree(t)
+			bin := filepath.Join(t.TempDir(), "tree.bin")
+			specs := []SlotSpec{{Label: "password", Key: secret.New([]byte(testPassword))}}
+			if err := ArchiveAndEncrypt(specs, 10, ArchiveOptions{Format: format}, root, bin); err != nil {
+				t.Fatalf("encrypting: %v", err)
+			}
+			names, err := SplitVolumes(bin, 1024, nil, nil, 10)
+			if err != nil {
+				t.Fatalf("splitting: %v", err)
+			}
+			if len(names) < 2 {
+				t.Fatalf("split into %d volumes", len(names))
+			}
+
+			t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+			result, err := Verify(Unlock{Key: secret.New([]byte(testPassword)), Slot: -1}, bin)
+			if err != nil {
+				t.Fatalf("verifying: %v", err)
+			}
+			if result.Format != format || result.Entries == 0 {
+				t.Errorf("verified %d entries of a %s archive", result.Entries, result.Format)
+			}
+
+			out := filepath.Join(t.TempDir(), "out")
+			if err := DecryptAndUnzipWith(Unlock{Key: secret.New([]byte(testPassword)), Slot: -1}, bin, out); err != nil {
+				t.Fatalf("decrypting: %v", err)
+			}
+			compareTrees(t, root, filepath.Join(out, filepath.Base(root)))
+		})
+	}
+}
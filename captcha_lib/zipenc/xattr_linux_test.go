@@ -0,0 +1,47 @@
+//go:build linux
+
+package zipenc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// only user.* attributes are restored from an archive unless PreserveSystemXattrs is set
+func TestSystemXattrsDropped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(path, "user.probe", []byte("1"), 0); err != nil {
+		t.Skipf("no user extended attributes on %s: %v", path, err)
+	}
+
+	PreserveXattrs = true
+	defer func() { PreserveXattrs = false }()
+	meta := entryMeta{
+		Mode:     0644,
+		Modified: time.Now(),
+		Xattrs: map[string][]byte{
+			"user.comment":        []byte("kept"),
+			"security.capability": {1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+	}
+	if err := restoreMetadata(path, meta); err != nil {
+		t.Fatalf("restoring: %v", err)
+	}
+	attrs, err := listXattrs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(attrs["user.comment"]) != "kept" {
+		t.Errorf("user.comment restored as %q", attrs["user.comment"])
+	}
+	if _, ok := attrs["security.capability"]; ok {
+		t.Error("security.capability restored from the archive")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package zipenc
+
+// extended attributes are only supported on linux
+func listXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func setXattrs(path string, attrs map[string][]byte) error {
+	return nil
+}
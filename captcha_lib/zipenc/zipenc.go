@@ -2,8 +2,8 @@ package zipenc
 
 import (
 	"archive/zip"
-	"captcha/captcha_lib/chess"
-	"captcha/captcha_lib/sudoku"
+	"bytes"
+	"captcha/captcha_lib/secret"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -13,7 +13,6 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -26,46 +25,92 @@ type ContextHeaderStruct struct {
 	HashPuzzle   bool   `json:"Hash"`
 	SudokuPuzzle bool   `json:"Sudoku"`
 	ChessOffsets []int  `json:"Offsets"`
+	// when set the payload is encrypted under a random data key which is
+	// wrapped once per slot, the fields above are then unused
+	Slots []KeySlot `json:"Slots,omitempty"`
+	// how the plaintext is packed, "" means a deflated zip archive
+	Format      string `json:"Format,omitempty"`
+	Compression string `json:"Compression,omitempty"`
+	// the redundancy in percent of the parity appended to the file, 0 for none
+	Parity int `json:"Parity,omitempty"`
+	// the length of the sealed payload, tells a truncated file from a modified one
+	// (FormatEntries files find truncation through their index instead)
+	Size int64 `json:"Size,omitempty"`
 }
 
-func zipFile(infile string, outfile string) error {
-	// create zip file
-	f, err := os.Create(outfile)
+// the archive options recorded in the header
+func (h ContextHeaderStruct) archive() ArchiveOptions {
+	opts, _ := ArchiveOptions{Format: h.Format, Compression: h.Compression}.normalize()
+	return opts
+}
+
+// zip infile (a file or folder) into w
+// entries are compressed with compression unless they are already compressed file types
+func zipFile(infile string, w io.Writer, compression string) error {
+	// create zip writer
+	writer := newZipWriter(w)
+	err := zipAdd(writer, infile, "", compression)
 	if err != nil {
+		writer.Close()
 		return err
 	}
-	defer f.Close()
+	// closing writes the central directory
+	return writer.Close()
+}
 
-	// create zip writer
-	writer := zip.NewWriter(f)
-	defer writer.Close()
+// a zip writer knowing the compressions archive/zip doesn't
+func newZipWriter(w io.Writer) *zip.Writer {
+	writer := zip.NewWriter(w)
+	writer.RegisterCompressor(zipMethodZstd, func(w io.Writer) (io.WriteCloser, error) { return &lazyWriter{w: w, compression: CompressZstd}, nil })
+	writer.RegisterCompressor(zipMethodXz, func(w io.Writer) (io.WriteCloser, error) { return &lazyWriter{w: w, compression: CompressXz}, nil })
+	return writer
+}
+
+// write infile (a file or folder) to writer, named below the archive folder prefix ("" for the top)
+func zipAdd(writer *zip.Writer, infile string, prefix string, compression string) error {
+	method := zip.Deflate
+	switch compression {
+	case CompressNone:
+		method = zip.Store
+	case CompressZstd:
+		method = zipMethodZstd
+	case CompressXz:
+		method = zipMethodXz
+	}
 
 	// walk through subdirectories (if any)
+	// Walk uses Lstat so symlinks are visited as links and not followed
 	return filepath.Walk(infile, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		// create zip file header
+		// create zip file header, this keeps the permission bits and modification time
 		header, err := zip.FileInfoHeader(info)
 		if err != nil {
 			return err
 		}
 
-		// choose compression option
-		header.Method = zip.Deflate
+		// choose compression option, already compressed files are stored as is
+		header.Method = method
+		if isCompressed(info.Name()) {
+			header.Method = zip.Store
+		}
 
 		// grab the filename
-		header.Name, err = filepath.Rel(filepath.Dir(infile), path)
+		header.Name, err = entryName(infile, path, prefix, info.IsDir())
 		if err != nil {
 			return err
 		}
 
-		// mark the directories with proper notation
+		// directories are stored
 		if info.IsDir() {
-			header.Name += "/"
+			header.Method = zip.Store
 		}
 
+		// keep the owner and extended attributes when asked to
+		header.Extra = append(header.Extra, metadataExtra(path, info)...)
+
 		// create header writer for zip file
 		headerWriter, err := writer.CreateHeader(header)
 		if err != nil {
@@ -76,6 +121,16 @@ func zipFile(infile string, outfile string) error {
 			return nil
 		}
 
+		// symlinks are stored as links, the content is the link target
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, err = headerWriter.Write([]byte(target))
+			return err
+		}
+
 		f, err := os.Open(path)
 		if err != nil {
 			return err
@@ -87,98 +142,159 @@ func zipFile(infile string, outfile string) error {
 	})
 }
 
-func unzipFile(infile string, outfile string) error {
-	r, err := zip.OpenReader(infile)
+// the archive name of path found while walking infile, below the archive folder prefix
+// directories are marked with a trailing slash
+func entryName(infile string, path string, prefix string, dir bool) (string, error) {
+	name, err := filepath.Rel(filepath.Dir(infile), path)
+	if err != nil {
+		return "", err
+	}
+	name = filepath.ToSlash(name)
+	if prefix != "" {
+		name = strings.Trim(prefix, "/") + "/" + name
+	}
+	if dir {
+		name += "/"
+	}
+	return name, nil
+}
+
+// extract the zip archive of the given size read from ra into the folder outfile
+// only the entries at or below paths are extracted, every entry when paths is empty
+// entries are checked against ExtractionPolicy
+func unzipFile(ra io.ReaderAt, size int64, outfile string, paths []string) error {
+	r, err := zip.NewReader(ra, size)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := r.Close(); err != nil {
-			panic(err)
-		}
-	}()
 
-	os.MkdirAll(outfile, 0755)
+	r.RegisterDecompressor(zipMethodZstd, func(r io.Reader) io.ReadCloser { return decompressOrFail(r, CompressZstd) })
+	r.RegisterDecompressor(zipMethodXz, func(r io.Reader) io.ReadCloser { return decompressOrFail(r, CompressXz) })
+
+	err = os.MkdirAll(outfile, 0755)
+	if err != nil {
+		return err
+	}
+	e := newExtraction(outfile)
+	e.choose(paths)
+
+	// directories get their permissions and times once everything inside them is written
+	type dirEntry struct {
+		path string
+		meta entryMeta
+	}
+	var dirs []dirEntry
 
 	// Closure to address file descriptors issue with all the deferred .Close() methods
 	extractAndWriteFile := func(f *zip.File) error {
-		rc, err := f.Open()
+		path, err := e.entry(f.Name)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			if err := rc.Close(); err != nil {
-				panic(err)
-			}
-		}()
 
-		path := filepath.Join(outfile, f.Name)
+		if f.FileInfo().IsDir() {
+			dirs = append(dirs, dirEntry{path, zipMeta(f)})
+			return os.MkdirAll(path, 0755)
+		}
 
-		// Check for ZipSlip (Directory traversal)
-		if !strings.HasPrefix(path, filepath.Clean(outfile)+string(os.PathSeparator)) {
-			return fmt.Errorf("illegal file path: %s", path)
+		// parent directories are created writable, their own entries fix the mode later
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
 		}
 
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(path, f.Mode())
-		} else {
-			os.MkdirAll(filepath.Dir(path), f.Mode())
-			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-			if err != nil {
-				return err
-			}
-			defer func() {
-				if err := f.Close(); err != nil {
-					panic(err)
-				}
-			}()
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
 
-			_, err = io.Copy(f, rc)
-			if err != nil {
-				return err
-			}
+		if f.Mode()&os.ModeSymlink != 0 {
+			return extractSymlink(e, rc, f.Name, path, zipMeta(f))
+		}
+
+		// O_EXCL as every entry goes to a fresh folder
+		out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, f.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		err = e.copy(out, rc, f.Name, int64(f.CompressedSize64))
+		if err == nil {
+			err = out.Sync()
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+		err = out.Close()
+		if err != nil {
+			return err
 		}
-		return nil
+		return restoreMetadata(path, zipMeta(f))
 	}
 
 	for _, f := range r.File {
+		if !e.wanted(f.Name) {
+			continue
+		}
 		err := extractAndWriteFile(f)
 		if err != nil {
 			return err
 		}
 	}
+	if err := e.missing(); err != nil {
+		return err
+	}
+
+	// deepest directories first so restoring a child doesn't change its parent again
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := restoreMetadata(dirs[i].path, dirs[i].meta)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-// SHA256 Hash function
-// input a string outputs the sha256 bytes
-func Hashs(s string, salt []byte) []byte {
-	h := sha256.New()
-	h.Write([]byte(s))
-	h.Write(salt)
-	bs := h.Sum(nil)
-	return bs
+// a reader that always fails, for decompressors that can't return an error
+type errReader struct {
+	err error
 }
 
-// N times SHA256 Hash function
-// input a string outputs the sha256 bytes
-// H(H(H(H(...string))))
-// requires N > 0
-func HashNs(s string, N uint16, salt []byte) []byte {
-	h := sha256.New()
-	h.Write([]byte(s))
-	h.Write(salt)
-	bs := h.Sum(nil)
-	for i := uint16(1); i < N; i++ {
-		h = sha256.New()
-		h.Write(bs)
-		bs = h.Sum(nil)
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+func (e errReader) Close() error             { return nil }
+
+// a decompressing reader for zip entries
+func decompressOrFail(r io.Reader, compression string) io.ReadCloser {
+	rc, err := decompressReader(r, compression)
+	if err != nil {
+		return errReader{err}
 	}
-	return bs
+	return rc
 }
 
-// same as Hashs but for byte strings
+// recreate a symlink entry read from rc
+// links are only restored when the extraction policy allows them
+func extractSymlink(e *extraction, rc io.Reader, name string, path string, meta entryMeta) error {
+	target, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return err
+	}
+	link := string(target)
+	err = e.symlink(name, path, link)
+	if err != nil {
+		return err
+	}
+	err = os.Symlink(link, path)
+	if err != nil {
+		return err
+	}
+	return restoreMetadata(path, meta)
+}
+
+// SHA256 Hash function
+// input bytes outputs the sha256 bytes
 func Hashb(bs []byte, salt []byte) []byte {
 	h := sha256.New()
 	h.Write(bs)
@@ -187,7 +303,8 @@ func Hashb(bs []byte, salt []byte) []byte {
 	return bsr
 }
 
-// same as HashNs but for byte strings
+// N times SHA256 Hash function
+// H(H(H(H(...bytes))))
 // requires N >= 0
 func HashNb(bs []byte, N uint16, salt []byte) []byte {
 	bsr := bs
@@ -204,191 +321,281 @@ func HashNb(bs []byte, N uint16, salt []byte) []byte {
 	return bsr
 }
 
-// Encrypt a file with AES GCM mode
-// takes in key, input filename, output filename
-func encrypt(keystr *string, puzzleKey [3]string, N uint16, infile string, outfile string, options [3]bool, offsets []int) (err error) {
-
-	salt := make([]byte, 16)
-	rand.Read(salt)
-	key := HashNs(*keystr+puzzleKey[0]+puzzleKey[1]+puzzleKey[2], N, salt)
-
-	// get the file plaintext
-	plainText, err := os.ReadFile(infile)
+// Encrypt a packed archive with AES GCM mode
+// takes in the unlock slots, the archive options to record, the archive, output filename
+// a random data key encrypts the archive and is wrapped under every slot
+func encrypt(specs []SlotSpec, N uint16, opts ArchiveOptions, plainText []byte, outfile string) (err error) {
+	key, header, err := newContainer(specs, N, opts)
 	if err != nil {
-		log.Fatalf("read file err: %v", err.Error())
 		return err
 	}
+	defer key.Wipe()
 
-	// create a new AES cipher using the key
-	block, err := aes.NewCipher(key)
+	cipherText, err := seal(key.Bytes(), plainText)
 	if err != nil {
-		log.Fatalf("cipher err: %v", err.Error())
-		return err
+		return fmt.Errorf("encrypt: %v", err)
 	}
 
-	// use GCM mode
-	gcm, err := cipher.NewGCM(block)
+	// write file to output, a crash never leaves a truncated file behind
+	return writeContainer(outfile, header, cipherText)
+}
+
+// create a random data key and the context header wrapping it once per slot
+func newContainer(specs []SlotSpec, N uint16, opts ArchiveOptions) (*secret.Secret, ContextHeaderStruct, error) {
+	var header ContextHeaderStruct
+	key := secret.New(make([]byte, 32))
+	_, err := io.ReadFull(rand.Reader, key.Bytes())
 	if err != nil {
-		log.Fatalf("cipher GCM err: %v", err.Error())
-		return err
+		key.Wipe()
+		return nil, header, fmt.Errorf("data key: %v", err)
+	}
+
+	header.Format = opts.Format
+	header.Compression = opts.Compression
+	header.Parity = opts.Parity
+	for _, spec := range specs {
+		slot, err := newSlot(key, spec, N)
+		if err != nil {
+			key.Wipe()
+			return nil, header, fmt.Errorf("wrap key: %v", err)
+		}
+		header.Slots = append(header.Slots, slot)
+	}
+	return key, header, nil
+}
+
+// encrypt plaintext with AES GCM mode under key
+// the returned ciphertext is prefixed with the nonce
+func seal(key []byte, plainText []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
 	}
 
 	// make nonce with gcm mode
 	nonce := make([]byte, gcm.NonceSize())
 	_, err = io.ReadFull(rand.Reader, nonce)
 	if err != nil {
-		log.Fatalf("nonce  err: %v", err.Error())
-		return err
+		return nil, err
 	}
 
-	// encrypt file
-	cipherText := gcm.Seal(nonce, nonce, plainText, nil)
+	return gcm.Seal(nonce, nonce, plainText, nil), nil
+}
 
-	// create the context header used to create the key
-	var header ContextHeaderStruct
-	header.HashPuzzle = options[0]
-	header.Chess = options[1]
-	header.ChessOffsets = offsets
-	header.SudokuPuzzle = options[2]
-	header.Salt = base64.StdEncoding.EncodeToString(salt)
-	header.N = N
-	headerB, err := json.Marshal(header)
+// decrypt a nonce prefixed ciphertext produced by seal
+func open(key []byte, cipherText []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
-		log.Fatalf("Error marshalling header: %v", err.Error())
-		return err
+		return nil, err
 	}
-	encrypted := append(headerB, cipherText...)
-	// write file to output
-	err = os.WriteFile(outfile, encrypted, 0777)
+
+	if len(cipherText) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	// remove nonce and decrypt
+	nonce := cipherText[:gcm.NonceSize()]
+	cipherText = cipherText[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, cipherText, nil)
+}
+
+// an AES GCM cipher under key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		log.Fatalf("write file err: %v", err.Error())
-		return err
+		return nil, err
 	}
-	return nil
+	return cipher.NewGCM(block)
 }
 
 // parse the context header used to create the key
-func parseHeader(text []byte) (ContextHeaderStruct, []byte) {
+func parseHeader(text []byte) (ContextHeaderStruct, []byte, error) {
 	var header ContextHeaderStruct
-	var index int
-	for i, _ := range text {
-		if text[i] == 0x7d {
-			index = i
-			break
-		}
-	}
-
-	err := json.Unmarshal(text[:index+1], &header)
+	// the header holds nested objects so decode exactly one json value
+	// and treat everything after it as ciphertext
+	dec := json.NewDecoder(bytes.NewReader(text))
+	err := dec.Decode(&header)
 	if err != nil {
-		log.Fatalf("Error unmarshalling header: %v", err.Error())
+		return header, nil, headerError(err)
 	}
-	return header, text[index+1:]
+	return header, text[dec.InputOffset():], nil
 }
 
 // Decrypts a file with AES GCM mode
-// takes in key, input filename, output filename
-func decrypt(keystr string, infile string, outfile string) (err error) {
+// takes in the unlock credentials and input filename
+// returns the header so the caller knows how to unpack the plaintext
+// the plaintext is only ever held in memory
+func decrypt(unlock Unlock, infile string) (header ContextHeaderStruct, plainText []byte, err error) {
 
-	// get the file plaintext
-	cipherText, err := os.ReadFile(infile)
+	// get the file ciphertext
+	header, cipherText, err := readContainer(infile)
 	if err != nil {
-		log.Fatal(err)
-		return err
+		return header, nil, err
 	}
+	plainText, err = decryptPayload(unlock, header, cipherText)
+	return header, plainText, err
+}
 
-	header, strippedCiphertext := parseHeader(cipherText)
-	cipherText = strippedCiphertext
-	salt, err := base64.StdEncoding.DecodeString(header.Salt)
+// unlock the container with header and decrypt its payload cipherText
+func decryptPayload(unlock Unlock, header ContextHeaderStruct, cipherText []byte) ([]byte, error) {
+	// a truncated file is told before any puzzle is asked
+	err := checkLength(header, cipherText)
 	if err != nil {
-		log.Fatalf("Error decoding salt: %v", err.Error())
+		return nil, err
 	}
-	var PuzzleKeyStr string
-	PuzzleKeyStr = ""
-	if header.SudokuPuzzle {
-		PuzzleKeyStr += sudoku.GetPuzzleKey(keystr, uint16(header.N))
-	}
-	if header.Chess {
-		res, _ := chess.GetPuzzleKey(keystr, header.ChessOffsets)
-		PuzzleKeyStr += res
-	}
-	if header.HashPuzzle {
-		// TODO: add hashpuzzle option
-		// PuzzleKeyStr += hashpuzzle.GetPuzzleKey()
+	key, err := unlockKey(unlock, header)
+	if err != nil {
+		return nil, fmt.Errorf("unlock: %w", err)
 	}
+	defer key.Wipe()
 
-	key := HashNs(keystr+PuzzleKeyStr, header.N, salt)
-
-	// create AES block
-	block, err := aes.NewCipher(key)
+	plainText, err := open(key.Bytes(), cipherText)
 	if err != nil {
-		log.Fatalf("cipher err: %v", err.Error())
-		return err
+		// without key slots nothing tells a wrong key from a modified file
+		if len(header.Slots) == 0 {
+			return nil, fmt.Errorf("decrypt file: %w or modified ciphertext", ErrWrongKey)
+		}
+		return nil, fmt.Errorf("decrypt file: %w", ErrTampered)
 	}
+	return plainText, nil
+}
 
-	// use GCM mode
-	gcm, err := cipher.NewGCM(block)
+// derive the key of a file written before key slots existed
+func legacyKey(key *secret.Secret, header ContextHeaderStruct) (*secret.Secret, error) {
+	salt, err := base64.StdEncoding.DecodeString(header.Salt)
 	if err != nil {
-		log.Fatalf("cipher GCM err: %v", err.Error())
-		return err
+		return nil, fmt.Errorf("decoding salt: %v", err)
 	}
+	slot := KeySlot{N: header.N, SudokuPuzzle: header.SudokuPuzzle, Chess: header.Chess, HashPuzzle: header.HashPuzzle, ChessSkips: header.ChessOffsets}
+	material, err := slotPuzzleKey(key, slot)
+	if err != nil {
+		return nil, err
+	}
+	return deriveKek(material, header.N, salt), nil
+}
 
-	// remove nonce and decrypt
-	nonce := cipherText[:gcm.NonceSize()]
-	cipherText = cipherText[gcm.NonceSize():]
-	plainText, err := gcm.Open(nil, nonce, cipherText, nil)
+// zip and encrypt infile with a single password slot
+// puzzles selects the sudoku, chess and hashpuzzle puzzles the slot is gated on
+// and puzzleKey holds their keys in that order (nil when unused)
+// skips are the chess puzzles skipped while the chess key was made
+func ZipAndEncrypt(key *secret.Secret, puzzles [3]bool, puzzleKey [3]*secret.Secret, N uint16, infile string, outfile string, skips []int) (err error) {
+	spec := SlotSpec{Label: "password", Key: key, Puzzles: puzzles, PuzzleKey: puzzleKey, ChessSkips: skips}
+	return ZipAndEncryptSlots([]SlotSpec{spec}, N, infile, outfile)
+}
+
+// zip and encrypt infile so that any one of the slots can open it
+func ZipAndEncryptSlots(specs []SlotSpec, N uint16, infile string, outfile string) (err error) {
+	return ArchiveAndEncrypt(specs, N, ArchiveOptions{}, infile, outfile)
+}
+
+// pack infile as described by opts and encrypt it so that any one of the slots can open it
+func ArchiveAndEncrypt(specs []SlotSpec, N uint16, opts ArchiveOptions, infile string, outfile string) (err error) {
+	if len(specs) == 0 {
+		return fmt.Errorf("at least one key slot is required")
+	}
+	opts, err = opts.normalize()
 	if err != nil {
-		log.Fatalf("decrypt file err: %v", err.Error())
 		return err
 	}
-
-	// write file to output
-	err = os.WriteFile(outfile, plainText, 0777)
+	// a single already compressed file is not worth compressing again
+	if opts.Format == FormatRaw && isCompressed(infile) {
+		opts.Compression = CompressNone
+	}
+	err = checkPolicy(specs, N)
 	if err != nil {
-		log.Fatalf("write file err: %v", err.Error())
 		return err
 	}
-	return nil
+	if opts.Format == FormatEntries {
+		return encryptEntries(specs, N, opts, infile, outfile)
+	}
+	// the archive is built in memory so no plaintext copy is left on disk
+	var archive bytes.Buffer
+	defer func() { secret.Wipe(archive.Bytes()) }()
+	err = pack(infile, &archive, opts)
+	if err != nil {
+		return fmt.Errorf("packing %s: %v", infile, err)
+	}
+	return encrypt(specs, N, opts, archive.Bytes(), outfile)
 }
 
-func ZipAndEncrypt(keystr *string, puzzleKey [3]string, N uint16, infile string, outfile string, offsets []int) (err error) {
+// decrypt and unzip infile, trying every slot in turn
+func DecryptAndUnzip(key *secret.Secret, infile string, outfile string) (err error) {
+	return DecryptAndUnzipSlot(key, -1, infile, outfile)
+}
+
+// decrypt and unzip infile using the given key slot (-1 tries each slot)
+func DecryptAndUnzipSlot(key *secret.Secret, slot int, infile string, outfile string) (err error) {
+	return DecryptAndUnzipWith(Unlock{Key: key, Slot: slot}, infile, outfile)
+}
 
-	var options [3]bool
-	options[0] = (puzzleKey[0] != "")
-	options[1] = (puzzleKey[1] != "")
-	options[2] = (puzzleKey[2] != "")
-	err = zipFile(infile, infile+".zip")
+// decrypt and unzip infile with any credentials (password and/or identities)
+// outfile is a folder, or a file when the archive was made with FormatRaw
+func DecryptAndUnzipWith(unlock Unlock, infile string, outfile string) (err error) {
+	return ExtractEntries(unlock, infile, outfile, nil)
+}
+
+// extract the entries at or below paths (everything when paths is empty) into the folder outfile
+// FormatEntries files only decrypt their index and the selected entries,
+// other archives are decrypted whole and unpacked selectively
+func ExtractEntries(unlock Unlock, infile string, outfile string, paths []string) (err error) {
+	m, ok, err := readManifest(infile)
 	if err != nil {
-		log.Fatalf("zip err: %v", err.Error())
 		return err
 	}
-	err = encrypt(keystr, puzzleKey, N, infile+".zip", outfile, options, offsets)
+	if ok {
+		// a file split into volumes is joined in memory, the way Verify checks it
+		container, err := joinVolumes(unlock, infile, m)
+		if err != nil {
+			return err
+		}
+		return extractContainer(unlock, container, outfile, paths)
+	}
+	header, _, err := readHeader(infile)
 	if err != nil {
-		log.Fatalf("encrypt err: %v", err.Error())
 		return err
 	}
-	err = os.Remove(infile + ".zip")
+	if header.Format == FormatEntries {
+		ef, err := openEntries(unlock, infile)
+		if err != nil {
+			return err
+		}
+		defer ef.Close()
+		return ef.extract(outfile, paths)
+	}
+
+	header, plainText, err := decrypt(unlock, infile)
 	if err != nil {
-		log.Fatalf("remove file err: %v", err.Error())
 		return err
 	}
-	return nil
+	defer secret.Wipe(plainText)
+	return unpack(plainText, outfile, header.archive(), paths)
 }
 
-func DecryptAndUnzip(keystr *string, infile string, outfile string) (err error) {
-	err = decrypt(*keystr, infile, infile+".zip")
+// extract the container held in memory the way ExtractEntries extracts a file
+func extractContainer(unlock Unlock, container []byte, outfile string, paths []string) error {
+	r := bytes.NewReader(container)
+	header, payload, err := payloadSection(r, int64(len(container)))
 	if err != nil {
-		log.Fatalf("write file err: %v", err.Error())
 		return err
 	}
-	err = unzipFile(infile+".zip", outfile)
+	if header.Format == FormatEntries {
+		ef, err := unlockEntries(unlock, header, payload)
+		if err != nil {
+			return err
+		}
+		defer ef.Close()
+		return ef.extract(outfile, paths)
+	}
+
+	// the parity is not part of the payload
+	header, cipherText, err := parseHeader(container[:containerSize(r, int64(len(container)))])
 	if err != nil {
-		log.Fatalf("write file err: %v", err.Error())
 		return err
 	}
-	err = os.Remove(infile + ".zip")
+	plainText, err := decryptPayload(unlock, header, cipherText)
 	if err != nil {
-		log.Fatalf("write file err: %v", err.Error())
 		return err
 	}
-	return nil
+	defer secret.Wipe(plainText)
+	return unpack(plainText, outfile, header.archive(), paths)
 }
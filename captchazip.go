@@ -1,65 +1,1252 @@
 package main
 
 import (
+	"bufio"
+	"captcha/captcha_lib/analyze"
+	"captcha/captcha_lib/board"
 	"captcha/captcha_lib/chess"
 	"captcha/captcha_lib/hashpuzzle"
+	"captcha/captcha_lib/passphrase"
+	"captcha/captcha_lib/render"
+	"captcha/captcha_lib/secret"
+	"captcha/captcha_lib/strength"
 	"captcha/captcha_lib/sudoku"
 	zipenc "captcha/captcha_lib/zipenc"
+	"crypto/ecdh"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	// "fmt"
 )
 
+// the puzzle windows need the main goroutine, the command runs beside them
 func main() {
-	debugLib := flag.String("debug", "hashpuzzle", "the target library to debug (runs Test)")
-	keystr := flag.String("key", "thisisthedefault", "the key to use for encryption or decryption")
+	board.Main(run)
+}
+
+func run() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "slot":
+			slotCommand(os.Args[2:])
+			return
+		case "keygen":
+			keygenCommand(os.Args[2:])
+			return
+		case "recipients":
+			recipientsCommand(os.Args[2:])
+			return
+		case "analyze":
+			analyzeCommand(os.Args[2:])
+			return
+		case "rekey":
+			rekeyCommand(os.Args[2:])
+			return
+		case "archive":
+			archiveCommand(os.Args[2:])
+			return
+		case "verify":
+			verifyCommand(os.Args[2:])
+			return
+		case "repair":
+			repairCommand(os.Args[2:])
+			return
+		case "join":
+			joinCommand(os.Args[2:])
+			return
+		case "share":
+			shareCommand(os.Args[2:])
+			return
+		case "render":
+			renderCommand(os.Args[2:])
+			return
+		}
+	}
+
+	debugLib := flag.String("debug", "", "a puzzle library to debug: sudoku, chess or hashpuzzle (chess and hashpuzzle print their key and stop before encrypting)")
+	keyFlag := flag.String("key", "", "the key to use for encryption or decryption (prefer -key-file, -key-env or the prompt)")
+	keyFile := flag.String("key-file", "", "a file whose first line is the key")
+	keyEnv := flag.String("key-env", "", "an environment variable holding the key")
 	N := flag.Int("hashes", 1000, "the number of hashes to perform on the key string")
 	decorenc := flag.Bool("enc", true, "encrypt (true), or decrypt (false)")
 	target := flag.String("in", "hhgttg.txt", "the file to zip and encrypt or decrypt and unzip")
 	dest := flag.String("out", "hhgttg.bin", "the destination file or folder")
+	slot := flag.Int("slot", -1, "the key slot to unlock when decrypting (-1 tries each slot)")
+	recipient := flag.String("recipient", "", "comma separated public keys to encrypt to (see keygen)")
+	recipientsFile := flag.String("recipients-file", "", "a file of public keys to encrypt to, one per line")
+	puzzles := flag.String("puzzles", "", "comma separated puzzles the password slot is gated on when encrypting (sudoku,chess,hashpuzzle)")
+	recipientPuzzles := flag.String("recipient-puzzles", "", "comma separated puzzles recipients must also solve (sudoku,chess,hashpuzzle)")
+	identity := flag.String("identity", "", "an identity file to decrypt with instead of a password")
+	minBits := flag.Float64("min-bits", strength.DefaultPolicy.MinBits, "the minimum estimated password entropy in bits when encrypting")
+	blocklist := flag.String("blocklist", "", "a file of passwords to refuse when encrypting, one per line")
+	owner := flag.Bool("owner", false, "store file owners and restore them when decrypting as root")
+	xattrs := flag.Bool("xattrs", false, "store and restore extended attributes (linux only)")
+	systemXattrs := flag.Bool("system-xattrs", false, "with -xattrs restore extended attributes outside user.* (security.*, trusted.*) when decrypting")
+	specialBits := flag.Bool("special-bits", false, "restore setuid, setgid and sticky bits when decrypting (stripped by default)")
+	format := flag.String("format", zipenc.FormatZip, "the archive format when encrypting: zip, tar, raw (a single file, decrypts back to a file) or entries (each file encrypted on its own, see archive extract)")
+	compression := flag.String("compress", "", "the compression when encrypting: none, deflate, gzip, zstd or xz (default deflate for zip, gzip for the other formats)")
+	parity := flag.Int("parity", 0, "append Reed-Solomon parity of this many percent of the file when encrypting, so damage can be repaired (see repair)")
+	volumeSize := flag.Int64("volume-size", 0, "split the encrypted file into volumes of at most this many bytes, the -out file becomes their manifest (0 doesn't split)")
+	volumePuzzles := flag.String("volume-puzzles", "", "gate volumes on puzzles of their own, e.g. \"2:chess;3:sudoku,hashpuzzle\" (needs a password)")
+	overwrite := flag.String("overwrite", zipenc.OverwriteNever, "when decrypting over existing files: never, ask or always")
+	symlinks := flag.String("symlinks", zipenc.SymlinksConfine, "symlinks in the archive: confine (only inside the output) or refuse")
+	maxSize := flag.Int64("max-size", zipenc.DefaultExtractPolicy.MaxTotalSize, "the most bytes an archive may expand to when decrypting (0 for no limit)")
+	maxEntries := flag.Int("max-entries", zipenc.DefaultExtractPolicy.MaxEntries, "the most entries an archive may hold when decrypting (0 for no limit)")
+	maxRatio := flag.Float64("max-ratio", zipenc.DefaultExtractPolicy.MaxRatio, "the largest compression ratio allowed when decrypting (0 for no limit)")
+	mlock := flag.Bool("mlock", false, "lock key material into memory so it is never swapped out (linux only)")
+	chessOptions := chessFlags(flag.CommandLine)
 	// for testing if decryption is enabled the destination must be a folder (based on the unzip method used)
+	// unless the file was encrypted with -format raw, then it is a file
 
 	flag.Parse()
+	chessOpts := chessOptions()
+
+	// a password is needed unless only public keys are used
+	source := passphrase.Source{Key: *keyFlag, File: *keyFile, Env: *keyEnv}
+	recipients := parseRecipients(*recipient, *recipientsFile)
+	usePassword := source.Given()
+	if *decorenc {
+		usePassword = usePassword || len(recipients) == 0
+	} else {
+		usePassword = usePassword || *identity == ""
+	}
+	setPolicy(*minBits, *blocklist)
+	zipenc.PreserveOwner = *owner
+	zipenc.PreserveXattrs = *xattrs
+	zipenc.PreserveSystemXattrs = *systemXattrs
+	zipenc.PreserveSpecialBits = *specialBits
+	setExtractPolicy(*overwrite, *symlinks, *maxSize, *maxEntries, *maxRatio)
+	secret.Lock = *mlock
+	var key *secret.Secret
+	if usePassword {
+		var err error
+		key, err = source.Read("Passphrase: ", *decorenc)
+		if err != nil {
+			log.Println(err)
+			os.Exit(-2)
+		}
+		// check the password before any puzzles are solved for it
+		if *decorenc {
+			err = zipenc.PasswordPolicy.Check(key.Bytes(), uint16(*N))
+			if err != nil {
+				log.Println(err)
+				os.Exit(-2)
+			}
+			fmt.Println("Password strength:", strength.WorkFactor(strength.Estimate(key.Bytes()).Bits, uint16(*N)))
+		}
+	}
+	defer key.Wipe()
 
-	var PuzzleKey [3]string
-	var K string
-	var offsets []int
-	offsets = nil
-	PuzzleKey[0] = ""
-	PuzzleKey[1] = ""
-	PuzzleKey[2] = ""
+	var err error
+	var PuzzleKey [3]*secret.Secret
+	var puzzleSet [3]bool
+	var skips []int
+	defer func() { wipeKeys(PuzzleKey) }()
 	switch *debugLib {
 	case "sudoku":
-		PuzzleKey[0] = sudoku.GetPuzzleKey(*keystr, uint16(*N))
-		fmt.Println(K)
+		puzzleSet[0] = true
+		PuzzleKey[0] = sudoku.GetPuzzleKey(key, uint16(*N))
+		fmt.Printf("%x\n", PuzzleKey[0].Bytes())
 		// return
 	case "chess":
-		PuzzleKey[1], offsets = chess.GetPuzzleKey(*keystr, nil)
+		PuzzleKey[1], skips, err = chess.GetPuzzleKey(key, chessOpts, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%x\nskipped: %v\n", PuzzleKey[1].Bytes(), skips)
 		return
 	case "hashpuzzle":
-		PuzzleKey[2] = hashpuzzle.GenerateHashKey(*keystr)
-		if len(PuzzleKey) > 0 {
-			fmt.Println(PuzzleKey[2])
+		PuzzleKey[2] = hashpuzzle.GenerateHashKey(key)
+		if !PuzzleKey[2].Empty() {
+			fmt.Println(string(PuzzleKey[2].Bytes()))
 		}
 		return
 	}
 
 	if *decorenc {
-		err := zipenc.ZipAndEncrypt(&K, PuzzleKey, uint16(*N), *target, *dest, offsets)
+		var specs []zipenc.SlotSpec
+		if usePassword {
+			if *puzzles != "" {
+				// the puzzles asked for replace those of -debug, with the chess skips to record
+				wipeKeys(PuzzleKey)
+				puzzleSet = parsePuzzleSet(*puzzles)
+				PuzzleKey, skips = solvePuzzles(key, puzzleSet, chessOpts, uint16(*N))
+			}
+			specs = append(specs, zipenc.SlotSpec{Label: "password", Key: key, Puzzles: puzzleSet, PuzzleKey: PuzzleKey, ChessSkips: skips, ChessOptions: chessOpts})
+		} else if *puzzles != "" {
+			log.Fatal("-puzzles gates the password slot, give a password or use -recipient-puzzles")
+		}
+		recipientSet := parsePuzzleSet(*recipientPuzzles)
+		for _, r := range recipients {
+			specs = append(specs, zipenc.SlotSpec{Label: "recipient", Recipient: r, Puzzles: recipientSet, ChessOptions: chessOpts})
+		}
+		opts := zipenc.ArchiveOptions{Format: *format, Compression: *compression, Parity: *parity}
+		err = zipenc.ArchiveAndEncrypt(specs, uint16(*N), opts, *target, *dest)
 		if err != nil {
 			//Print error message:
 			log.Println(err)
 			os.Exit(-2)
 		}
+		if *volumeSize > 0 {
+			volumes, err := zipenc.SplitVolumes(*dest, *volumeSize, key, parseVolumeGates(*volumePuzzles, chessOpts), uint16(*N))
+			if err != nil {
+				log.Println(err)
+				os.Exit(-2)
+			}
+			fmt.Printf("split into %d volume(s), %s is their manifest\n", len(volumes), *dest)
+		}
 	} else {
-		err := zipenc.DecryptAndUnzip(&K, *target, *dest)
+		unlock := zipenc.Unlock{Key: key, Slot: *slot}
+		if *identity != "" {
+			unlock.Identities, err = zipenc.ReadIdentityFile(*identity)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		err = zipenc.DecryptAndUnzipWith(unlock, *target, *dest)
 		if err != nil {
 			//Print error message:
+			log.Println(err)
+			repairHint(*target, err)
+			os.Exit(-2)
+		}
+	}
+
+}
+
+// register the flags choosing how chess puzzles are made on fs
+// the function returned loads the database once the flags are parsed and
+// returns the settings new keys are made with, they are stored with each slot
+// so decrypting only needs the database a slot was created with unless it is the built in one
+// it also sets the scan budget, reports the scan's progress and stops it on Ctrl-C
+func chessFlags(fs *flag.FlagSet) func() *chess.ChessOptions {
+	db := fs.String("chess-db", "", "draw chess puzzles from a puzzle database: embedded, or a Lichess CSV, EPD or PGN file (default random games analysed by the engine)")
+	minRating := fs.Int("chess-min-rating", 0, "the lowest rating of the puzzles drawn from -chess-db (0 for no limit)")
+	maxRating := fs.Int("chess-max-rating", 0, "the highest rating of the puzzles drawn from -chess-db (0 for no limit)")
+	line := fs.Int("chess-line", 1, "the moves to play per chess puzzle, more than 1 asks for a forcing line with the opponent's replies played automatically")
+	puzzles := fs.Int("chess-puzzles", chess.PuzzleKeyLen, "the number of chess puzzles to solve")
+	cutoff := fs.Int("chess-cutoff", chess.CUTOFF, "the swing in centipawns that makes a position of a random game a chess puzzle")
+	evalTime := fs.Duration("chess-eval-time", chess.DefaultEngineTime, "how long the engine looks at each position of the random games")
+	solveTime := fs.Duration("chess-solve-time", chess.DefaultSolutionTime, "how long the engine looks for the solution of a chess puzzle")
+	maxSkips := fs.Int("chess-max-skips", chess.DefaultMaxSkips, "the chess puzzles that may be skipped in place of each one solved")
+	maxGames := fs.Int("chess-max-games", chess.Scan.MaxGames, "the random games to play looking for chess puzzles before giving up (0 for no limit)")
+	maxPositions := fs.Int("chess-max-positions", chess.Scan.MaxPositions, "the positions of random games to evaluate looking for chess puzzles before giving up (0 for no limit)")
+	return func() *chess.ChessOptions {
+		if *maxGames < 0 || *maxPositions < 0 {
+			log.Fatal("-chess-max-games and -chess-max-positions must not be negative")
+		}
+		chess.Scan = chess.ScanOptions{MaxGames: *maxGames, MaxPositions: *maxPositions, Progress: scanProgress(), Interrupt: true}
+		var src chess.PuzzleSource
+		if *db != "" {
+			puzzles, err := chess.LoadPuzzleDB(*db)
+			if err != nil {
+				log.Fatal(err)
+			}
+			src = puzzles.Source(*minRating, *maxRating)
+		}
+		if *line < 1 {
+			log.Fatalf("-chess-line %d is not positive", *line)
+		}
+		if *line > 1 {
+			src.Line = *line
+		}
+		if *puzzles < 1 || *cutoff < 1 || *evalTime <= 0 || *solveTime <= 0 {
+			log.Fatal("-chess-puzzles, -chess-cutoff, -chess-eval-time and -chess-solve-time must be positive")
+		}
+
+		// only the settings changed are stored with the revision of the search, the rest are the defaults
+		opts := chess.ChessOptions{Version: chess.CurrentVersion}
+		if src != (chess.PuzzleSource{}) {
+			opts.Source = &src
+		}
+		if *puzzles != chess.PuzzleKeyLen {
+			opts.Puzzles = *puzzles
+		}
+		if *cutoff != chess.CUTOFF {
+			opts.Cutoff = *cutoff
+		}
+		if *evalTime != chess.DefaultEngineTime {
+			opts.EngineTime = *evalTime
+		}
+		if *solveTime != chess.DefaultSolutionTime {
+			opts.SolutionTime = *solveTime
+		}
+		if *maxSkips != chess.DefaultMaxSkips {
+			if *maxSkips < 1 {
+				log.Fatalf("-chess-max-skips %d is not positive", *maxSkips)
+			}
+			opts.MaxSkips = *maxSkips
+		}
+		if err := opts.Check(); err != nil {
+			log.Fatal(err)
+		}
+		return &opts
+	}
+}
+
+// the positions between the progress lines of the chess puzzle scan
+const progressEvery = 1000
+
+// a reporter of the chess puzzle scan, printing a line every progressEvery positions and when a puzzle is found
+func scanProgress() func(chess.ScanProgress) {
+	found := 0
+	return func(p chess.ScanProgress) {
+		if p.Done || p.Positions%progressEvery == 0 || p.Found != found {
+			found = p.Found
+			fmt.Fprintf(os.Stderr, "chess scan: %d positions of %d games, %d of %d puzzles found\n", p.Positions, p.Games, p.Found, p.Wanted)
+		}
+	}
+}
+
+// solve the puzzles selected (sudoku, chess, hashpuzzle in that order) for key
+// the chess puzzles are made with chessOpts (the defaults when nil)
+// returns the puzzle keys in the order zipenc expects and the chess puzzles skipped
+func solvePuzzles(key *secret.Secret, puzzles [3]bool, chessOpts *chess.ChessOptions, N uint16) ([3]*secret.Secret, []int) {
+	var PuzzleKey [3]*secret.Secret
+	var skips []int
+	if puzzles[0] {
+		PuzzleKey[0] = sudoku.GetPuzzleKey(key, N)
+	}
+	if puzzles[1] {
+		var err error
+		PuzzleKey[1], skips, err = chess.GetPuzzleKey(key, chessOpts, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if puzzles[2] {
+		PuzzleKey[2] = hashpuzzle.GenerateHashKey(key)
+	}
+	return PuzzleKey, skips
+}
+
+// wipe the puzzle keys once they are wrapped into a slot
+func wipeKeys(PuzzleKey [3]*secret.Secret) {
+	for _, k := range PuzzleKey {
+		k.Wipe()
+	}
+}
+
+// configure the password policy zipenc enforces
+func setPolicy(minBits float64, blocklist string) {
+	zipenc.PasswordPolicy.MinBits = minBits
+	if blocklist == "" {
+		return
+	}
+	content, err := os.ReadFile(blocklist)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			zipenc.PasswordPolicy.Blocklist = append(zipenc.PasswordPolicy.Blocklist, line)
+		}
+	}
+}
+
+// configure the limits zipenc extracts archives with
+func setExtractPolicy(overwrite string, symlinks string, maxSize int64, maxEntries int, maxRatio float64) {
+	switch overwrite {
+	case zipenc.OverwriteNever, zipenc.OverwriteAsk, zipenc.OverwriteAlways:
+	default:
+		log.Fatalf("unknown -overwrite %q, use never, ask or always", overwrite)
+	}
+	switch symlinks {
+	case zipenc.SymlinksConfine, zipenc.SymlinksRefuse:
+	default:
+		log.Fatalf("unknown -symlinks %q, use confine or refuse", symlinks)
+	}
+	zipenc.ExtractionPolicy = zipenc.ExtractPolicy{
+		MaxTotalSize: maxSize,
+		MaxEntries:   maxEntries,
+		MaxRatio:     maxRatio,
+		Symlinks:     symlinks,
+		Overwrite:    overwrite,
+	}
+}
+
+// parse a comma separated list of puzzles into the order zipenc expects
+func parsePuzzleSet(puzzles string) [3]bool {
+	var set [3]bool
+	for _, p := range strings.Split(puzzles, ",") {
+		switch strings.TrimSpace(p) {
+		case "":
+		case "sudoku":
+			set[0] = true
+		case "chess":
+			set[1] = true
+		case "hashpuzzle":
+			set[2] = true
+		default:
+			log.Fatalf("unknown puzzle %q", p)
+		}
+	}
+	return set
+}
+
+// parse volume gates given as "volume:puzzles" separated by semicolons
+// the chess puzzles are made with chessOpts (the defaults when nil)
+func parseVolumeGates(gates string, chessOpts *chess.ChessOptions) []zipenc.VolumeGate {
+	var parsed []zipenc.VolumeGate
+	for _, g := range strings.Split(gates, ";") {
+		if strings.TrimSpace(g) == "" {
+			continue
+		}
+		volume, puzzles, ok := strings.Cut(g, ":")
+		n, err := strconv.Atoi(strings.TrimSpace(volume))
+		if !ok || err != nil {
+			log.Fatalf("volume gate %q is not volume:puzzles", g)
+		}
+		parsed = append(parsed, zipenc.VolumeGate{Volume: n, Puzzles: parsePuzzleSet(puzzles), ChessOptions: chessOpts})
+	}
+	return parsed
+}
+
+// collect the recipients given on the command line and in a recipients file
+func parseRecipients(list string, file string) []*ecdh.PublicKey {
+	var recipients []*ecdh.PublicKey
+	for _, r := range strings.Split(list, ",") {
+		if strings.TrimSpace(r) == "" {
+			continue
+		}
+		pub, err := zipenc.ParseRecipient(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recipients = append(recipients, pub)
+	}
+	if file != "" {
+		fromFile, err := zipenc.ReadRecipientsFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recipients = append(recipients, fromFile...)
+	}
+	return recipients
+}
+
+// manage the key slots of an encrypted file
+// usage: captchazip slot list|add|remove [flags]
+func slotCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: captchazip slot list|add|remove [flags]")
+	}
+	fs := flag.NewFlagSet("slot "+args[0], flag.ExitOnError)
+	target := fs.String("in", "hhgttg.bin", "the encrypted file")
+	keyFlag := fs.String("key", "", "the key of an existing slot (prefer -key-file, -key-env or the prompt)")
+	keyFile := fs.String("key-file", "", "a file whose first line is the key of an existing slot")
+	keyEnv := fs.String("key-env", "", "an environment variable holding the key of an existing slot")
+	unlock := fs.Int("unlock", -1, "the existing slot to unlock (-1 tries each slot)")
+	newkey := fs.String("newkey", "", "the key for the new slot (prefer -newkey-file, -newkey-env or the prompt)")
+	newkeyFile := fs.String("newkey-file", "", "a file whose first line is the key for the new slot")
+	newkeyEnv := fs.String("newkey-env", "", "an environment variable holding the key for the new slot")
+	puzzles := fs.String("puzzles", "", "comma separated puzzles gating the new slot (sudoku,chess,hashpuzzle)")
+	label := fs.String("label", "", "a label for the new slot")
+	N := fs.Int("hashes", 1000, "the number of hashes to perform on the new slot key")
+	index := fs.Int("slot", -1, "the slot to remove")
+	recipient := fs.String("recipient", "", "add a slot wrapped to this public key instead of -newkey")
+	recipientPuzzles := fs.String("recipient-puzzles", "", "comma separated puzzles the recipient must also solve")
+	identity := fs.String("identity", "", "an identity file to unlock the existing slot with")
+	minBits := fs.Float64("min-bits", strength.DefaultPolicy.MinBits, "the minimum estimated entropy in bits of the new key")
+	blocklist := fs.String("blocklist", "", "a file of passwords to refuse for the new key, one per line")
+	chessOptions := chessFlags(fs)
+	fs.Parse(args[1:])
+	setPolicy(*minBits, *blocklist)
+
+	var err error
+	switch args[0] {
+	case "list":
+		var slots []zipenc.KeySlot
+		slots, err = zipenc.ListSlots(*target)
+		for i, s := range slots {
+			kind := "password"
+			if s.Recipient != "" {
+				kind = s.Recipient
+			}
+			fmt.Printf("%d: %s [%s] (hashes=%d sudoku=%t chess=%t hashpuzzle=%t)\n", i, s.Label, kind, s.N, s.SudokuPuzzle, s.Chess, s.HashPuzzle)
+		}
+	case "add":
+		source := passphrase.Source{Key: *keyFlag, File: *keyFile, Env: *keyEnv}
+		u := readUnlock(*unlock, source, *identity)
+		defer u.Key.Wipe()
+		newSource := passphrase.Source{Key: *newkey, File: *newkeyFile, Env: *newkeyEnv}
+		spec := newSlotSpec(*label, *recipient, *recipientPuzzles, newSource, *puzzles, chessOptions(), uint16(*N))
+		defer wipeSpec(spec)
+		err = zipenc.AddSlot(u, spec, uint16(*N), *target)
+	case "remove":
+		err = zipenc.RemoveSlot(*index, *target)
+	default:
+		log.Fatalf("unknown slot command %q", args[0])
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(-2)
+	}
+}
+
+// the credentials unlocking an existing slot: a passphrase, identities or both
+func readUnlock(slot int, source passphrase.Source, identity string) zipenc.Unlock {
+	u := zipenc.Unlock{Slot: slot}
+	var err error
+	if identity != "" {
+		u.Identities, err = zipenc.ReadIdentityFile(identity)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if identity == "" || source.Given() {
+		u.Key, err = source.Read("Existing passphrase: ", false)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return u
+}
+
+// describe a new slot, wrapped to recipient when given and to a new passphrase
+// gated on puzzles otherwise, wipeSpec wipes its keys once it is used
+func newSlotSpec(label string, recipient string, recipientPuzzles string, source passphrase.Source, puzzles string, chessOpts *chess.ChessOptions, N uint16) zipenc.SlotSpec {
+	if recipient != "" {
+		pub, err := zipenc.ParseRecipient(recipient)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return zipenc.SlotSpec{Label: label, Recipient: pub, Puzzles: parsePuzzleSet(recipientPuzzles), ChessOptions: chessOpts}
+	}
+	key, err := source.Read("New passphrase: ", true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// check the password before any puzzles are solved for it
+	if err := zipenc.PasswordPolicy.Check(key.Bytes(), N); err != nil {
+		key.Wipe()
+		log.Fatal(err)
+	}
+	set := parsePuzzleSet(puzzles)
+	PuzzleKey, skips := solvePuzzles(key, set, chessOpts, N)
+	return zipenc.SlotSpec{Label: label, Key: key, Puzzles: set, PuzzleKey: PuzzleKey, ChessSkips: skips, ChessOptions: chessOpts}
+}
+
+// wipe the keys of a slot description
+func wipeSpec(spec zipenc.SlotSpec) {
+	spec.Key.Wipe()
+	wipeKeys(spec.PuzzleKey)
+}
+
+// change the password, puzzles or hash iterations of an encrypted file
+// usage: captchazip rekey -in file [flags]
+func rekeyCommand(args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	target := fs.String("in", "hhgttg.bin", "the encrypted file")
+	keyFlag := fs.String("key", "", "the current key (prefer -key-file, -key-env or the prompt)")
+	keyFile := fs.String("key-file", "", "a file whose first line is the current key")
+	keyEnv := fs.String("key-env", "", "an environment variable holding the current key")
+	unlock := fs.Int("slot", -1, "the slot to re-key (-1 tries each slot)")
+	identity := fs.String("identity", "", "an identity file to unlock the slot with")
+	newkey := fs.String("newkey", "", "the new key (prefer -newkey-file, -newkey-env or the prompt)")
+	newkeyFile := fs.String("newkey-file", "", "a file whose first line is the new key")
+	newkeyEnv := fs.String("newkey-env", "", "an environment variable holding the new key")
+	puzzles := fs.String("puzzles", "", "comma separated puzzles gating the new key (sudoku,chess,hashpuzzle)")
+	label := fs.String("label", "", "a new label for the slot (default keeps the old one)")
+	N := fs.Int("hashes", 1000, "the number of hashes to perform on the new key")
+	recipient := fs.String("recipient", "", "wrap the slot to this public key instead of -newkey")
+	recipientPuzzles := fs.String("recipient-puzzles", "", "comma separated puzzles the recipient must also solve")
+	rotate := fs.Bool("rotate", false, "also replace the data key and re-encrypt the payload (drops every other slot)")
+	minBits := fs.Float64("min-bits", strength.DefaultPolicy.MinBits, "the minimum estimated entropy in bits of the new key")
+	blocklist := fs.String("blocklist", "", "a file of passwords to refuse for the new key, one per line")
+	mlock := fs.Bool("mlock", false, "lock key material into memory so it is never swapped out (linux only)")
+	chessOptions := chessFlags(fs)
+	fs.Parse(args)
+	setPolicy(*minBits, *blocklist)
+	secret.Lock = *mlock
+
+	source := passphrase.Source{Key: *keyFlag, File: *keyFile, Env: *keyEnv}
+	u := readUnlock(*unlock, source, *identity)
+	defer u.Key.Wipe()
+	newSource := passphrase.Source{Key: *newkey, File: *newkeyFile, Env: *newkeyEnv}
+	spec := newSlotSpec(*label, *recipient, *recipientPuzzles, newSource, *puzzles, chessOptions(), uint16(*N))
+	defer wipeSpec(spec)
+
+	result, err := zipenc.Rekey(u, zipenc.RekeyOptions{Spec: spec, N: uint16(*N), Rotate: *rotate}, *target)
+	if err != nil {
+		log.Println(err)
+		os.Exit(-2)
+	}
+	switch {
+	case result.Slot < 0:
+		fmt.Println("re-encrypted the file with key slots")
+	case result.Rotated:
+		fmt.Printf("re-keyed slot %d and rotated the data key, %d other slot(s) removed\n", result.Slot, result.Dropped)
+	default:
+		fmt.Printf("re-keyed slot %d\n", result.Slot)
+	}
+}
+
+// exit codes of verify, other failures exit with -2
+const (
+	exitWrongKey  = 3
+	exitTampered  = 4
+	exitTruncated = 5
+	exitCorrupt   = 6
+)
+
+// check an encrypted file and the archive inside it without writing anything
+// usage: captchazip verify -in file [flags]
+func verifyCommand(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	target := fs.String("in", "hhgttg.bin", "the encrypted file")
+	keyFlag := fs.String("key", "", "the key (prefer -key-file, -key-env or the prompt)")
+	keyFile := fs.String("key-file", "", "a file whose first line is the key")
+	keyEnv := fs.String("key-env", "", "an environment variable holding the key")
+	slot := fs.Int("slot", -1, "the key slot to unlock (-1 tries each slot)")
+	identity := fs.String("identity", "", "an identity file to unlock with instead of a password")
+	mlock := fs.Bool("mlock", false, "lock key material into memory so it is never swapped out (linux only)")
+	chessOptions := chessFlags(fs)
+	fs.Parse(args)
+	chessOptions()
+	secret.Lock = *mlock
+
+	source := passphrase.Source{Key: *keyFlag, File: *keyFile, Env: *keyEnv}
+	u := readUnlock(*slot, source, *identity)
+	result, err := zipenc.Verify(u, *target)
+	u.Key.Wipe()
+	if err != nil {
+		log.Println(err)
+		repairHint(*target, err)
+		switch {
+		case errors.Is(err, zipenc.ErrWrongKey):
+			os.Exit(exitWrongKey)
+		case errors.Is(err, zipenc.ErrTampered):
+			os.Exit(exitTampered)
+		case errors.Is(err, zipenc.ErrTruncated):
+			os.Exit(exitTruncated)
+		case errors.Is(err, zipenc.ErrCorrupt):
+			os.Exit(exitCorrupt)
+		}
+		os.Exit(-2)
+	}
+	fmt.Printf("%s: ok, %s archive (%s) with %d entries expanding to %d bytes\n", *target, result.Format, result.Compression, result.Entries, result.Size)
+}
+
+// point at repair when a damaged file carries parity
+func repairHint(file string, err error) {
+	if (errors.Is(err, zipenc.ErrTampered) || errors.Is(err, zipenc.ErrTruncated) || errors.Is(err, zipenc.ErrCorrupt)) && zipenc.HasParity(file) {
+		fmt.Printf("%s carries parity, try: captchazip repair -in %s\n", file, file)
+	}
+}
+
+// rebuild the damaged parts of a file from its parity, or change its parity
+// usage: captchazip repair -in file [-out file] [-parity percent]
+func repairCommand(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	target := fs.String("in", "hhgttg.bin", "the encrypted file")
+	out := fs.String("out", "", "where to write the repaired file (default replaces -in)")
+	parity := fs.Int("parity", -1, "change the parity to this many percent of the file (0 removes it, -1 keeps it)")
+	fs.Parse(args)
+	if *out == "" {
+		*out = *target
+	}
+
+	// a repaired file is written to -out, any new parity is set there
+	file := *target
+	if zipenc.HasParity(*target) {
+		result, err := zipenc.Repair(*target, *out)
+		if err != nil {
+			log.Println(err)
+			os.Exit(-2)
+		}
+		switch {
+		case result.Repaired > 0:
+			fmt.Printf("repaired %d damaged shard(s)\n", result.Repaired)
+		case result.Descriptor:
+			fmt.Println("repaired a damaged copy of the parity descriptor")
+		default:
+			fmt.Println("no damage found")
+		}
+		file = *out
+	} else if *parity < 0 {
+		log.Printf("%s carries no parity (add some with -parity)", *target)
+		os.Exit(-2)
+	}
+
+	if *parity >= 0 {
+		if err := zipenc.SetParity(file, *out, *parity); err != nil {
+			log.Println(err)
+			os.Exit(-2)
+		}
+		fmt.Printf("parity set to %d%%\n", *parity)
+	}
+}
+
+// join the volumes of a split file back into the encrypted file, solving their gates
+// usage: captchazip join -in manifest -out file
+func joinCommand(args []string) {
+	fs := flag.NewFlagSet("join", flag.ExitOnError)
+	target := fs.String("in", "hhgttg.bin", "the manifest of the volumes")
+	out := fs.String("out", "", "where to write the joined file (default replaces the manifest)")
+	keyFlag := fs.String("key", "", "the key gated volumes are opened with (prefer -key-file, -key-env or the prompt)")
+	keyFile := fs.String("key-file", "", "a file whose first line is the key")
+	keyEnv := fs.String("key-env", "", "an environment variable holding the key")
+	mlock := fs.Bool("mlock", false, "lock key material into memory so it is never swapped out (linux only)")
+	chessOptions := chessFlags(fs)
+	fs.Parse(args)
+	chessOptions()
+	secret.Lock = *mlock
+	if *out == "" {
+		*out = *target
+	}
+
+	// only gated volumes need the password
+	source := passphrase.Source{Key: *keyFlag, File: *keyFile, Env: *keyEnv}
+	u := zipenc.Unlock{Slot: -1}
+	if source.Given() || zipenc.HasGatedVolumes(*target) {
+		var err error
+		u.Key, err = source.Read("Passphrase: ", false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer u.Key.Wipe()
+	}
+	err := zipenc.JoinVolumes(u, *target, *out)
+	if err != nil {
+		log.Println(err)
+		os.Exit(-2)
+	}
+	fmt.Printf("joined the volumes into %s\n", *out)
+}
+
+// split the data key of a file into password protected shares for a team, or
+// combine enough shares to decrypt the file
+// usage: captchazip share split|combine -in file [flags]
+func shareCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: captchazip share split|combine [flags]")
+	}
+	fs := flag.NewFlagSet("share "+args[0], flag.ExitOnError)
+	target := fs.String("in", "hhgttg.bin", "the encrypted file")
+	keyFlag := fs.String("key", "", "the key of an existing slot when splitting (prefer -key-file, -key-env or the prompt)")
+	keyFile := fs.String("key-file", "", "a file whose first line is the key of an existing slot")
+	keyEnv := fs.String("key-env", "", "an environment variable holding the key of an existing slot")
+	unlock := fs.Int("unlock", -1, "the existing slot to unlock (-1 tries each slot)")
+	identity := fs.String("identity", "", "an identity file to unlock the existing slot with")
+	holders := fs.String("holders", "", "comma separated names of the share holders, one share each")
+	threshold := fs.Int("threshold", 2, "the number of shares that recover the key")
+	puzzles := fs.String("puzzles", "", "puzzles gating every share (sudoku,chess,hashpuzzle), or one list per holder separated by semicolons")
+	holderKeyFiles := fs.String("holder-key-files", "", "comma separated files whose first lines are the holders' keys, in order (prefer the prompt)")
+	N := fs.Int("hashes", 1000, "the number of hashes to perform on the holders' keys")
+	shares := fs.String("shares", "", "comma separated share files to combine")
+	out := fs.String("out", "", "the share file prefix when splitting (default -in), the folder to decrypt into when combining")
+	minBits := fs.Float64("min-bits", strength.DefaultPolicy.MinBits, "the minimum estimated entropy in bits of the holders' keys")
+	blocklist := fs.String("blocklist", "", "a file of passwords to refuse for the holders' keys, one per line")
+	mlock := fs.Bool("mlock", false, "lock key material into memory so it is never swapped out (linux only)")
+	chessOptions := chessFlags(fs)
+	fs.Parse(args[1:])
+	chessOpts := chessOptions()
+	setPolicy(*minBits, *blocklist)
+	secret.Lock = *mlock
+	keyFiles := splitList(*holderKeyFiles)
+
+	switch args[0] {
+	case "split":
+		names := splitList(*holders)
+		holderPuzzles := strings.Split(*puzzles, ";")
+		if len(holderPuzzles) != 1 && len(holderPuzzles) != len(names) {
+			log.Fatalf("%d puzzle lists given for %d holders", len(holderPuzzles), len(names))
+		}
+		if *out == "" {
+			*out = *target
+		}
+		source := passphrase.Source{Key: *keyFlag, File: *keyFile, Env: *keyEnv}
+		u := readUnlock(*unlock, source, *identity)
+		defer u.Key.Wipe()
+
+		var specs []zipenc.SlotSpec
+		defer func() {
+			for _, spec := range specs {
+				wipeSpec(spec)
+			}
+		}()
+		for i, name := range names {
+			fmt.Printf("share %d for %s\n", i+1, name)
+			p := holderPuzzles[0]
+			if len(holderPuzzles) > 1 {
+				p = holderPuzzles[i]
+			}
+			holderSource := passphrase.Source{}
+			if i < len(keyFiles) {
+				holderSource.File = keyFiles[i]
+			}
+			specs = append(specs, newSlotSpec(name, "", "", holderSource, p, chessOpts, uint16(*N)))
+		}
+		files, err := zipenc.SplitKey(u, *target, *threshold, specs, uint16(*N), *out)
+		if err != nil {
+			log.Println(err)
+			os.Exit(-2)
+		}
+		fmt.Printf("any %d of these recover the key of %s:\n", *threshold, *target)
+		for i, f := range files {
+			fmt.Printf("  %s (%s)\n", f, names[i])
+		}
+	case "combine":
+		if *out == "" {
+			log.Fatal("-out is required to combine shares")
+		}
+		var opened []*zipenc.Share
+		defer func() {
+			for _, s := range opened {
+				s.Wipe()
+			}
+		}()
+		for i, file := range splitList(*shares) {
+			s, err := zipenc.ReadShare(file)
+			if err != nil {
+				log.Fatal(err)
+			}
+			holderSource := passphrase.Source{}
+			if i < len(keyFiles) {
+				holderSource.File = keyFiles[i]
+			}
+			key, err := holderSource.Read(fmt.Sprintf("Passphrase of %s (share %d of %s): ", s.Label, s.Index, s.File), false)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = s.Open(zipenc.Unlock{Key: key, Slot: -1})
+			key.Wipe()
+			if err != nil {
+				log.Println(err)
+				os.Exit(-2)
+			}
+			opened = append(opened, s)
+		}
+		key, err := zipenc.CombineShares(opened)
+		if err != nil {
+			log.Println(err)
+			os.Exit(-2)
+		}
+		defer key.Wipe()
+		err = zipenc.DecryptAndUnzipWith(zipenc.Unlock{DataKey: key, Slot: -1}, *target, *out)
+		if err != nil {
+			log.Println(err)
+			repairHint(*target, err)
+			os.Exit(-2)
+		}
+	default:
+		log.Fatalf("unknown share command %q", args[0])
+	}
+}
+
+// the non empty items of a comma separated list
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// edit the archive inside an encrypted file without re-encrypting it from scratch
+// or extract some of its entries
+// usage: captchazip archive list|add|remove|session|extract -in file [flags] [paths]
+func archiveCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: captchazip archive list|add|remove|session|extract [flags] [paths]")
+	}
+	fs := flag.NewFlagSet("archive "+args[0], flag.ExitOnError)
+	target := fs.String("in", "hhgttg.bin", "the encrypted file")
+	keyFlag := fs.String("key", "", "the key (prefer -key-file, -key-env or the prompt)")
+	keyFile := fs.String("key-file", "", "a file whose first line is the key")
+	keyEnv := fs.String("key-env", "", "an environment variable holding the key")
+	slot := fs.Int("slot", -1, "the key slot to unlock (-1 tries each slot)")
+	identity := fs.String("identity", "", "an identity file to unlock with instead of a password")
+	dir := fs.String("dir", "", "the folder inside the archive files are added to")
+	out := fs.String("out", ".", "the folder extract writes to")
+	overwrite := fs.String("overwrite", zipenc.OverwriteNever, "when extracting over existing files: never, ask or always")
+	mlock := fs.Bool("mlock", false, "lock key material into memory so it is never swapped out (linux only)")
+	chessOptions := chessFlags(fs)
+	fs.Parse(args[1:])
+	chessOptions()
+	secret.Lock = *mlock
+
+	switch args[0] {
+	case "list", "add", "remove", "session", "extract":
+	default:
+		log.Fatalf("unknown archive command %q", args[0])
+	}
+
+	source := passphrase.Source{Key: *keyFlag, File: *keyFile, Env: *keyEnv}
+	u := readUnlock(*slot, source, *identity)
+
+	// files encrypted with -format entries only decrypt the entries asked for
+	if args[0] == "extract" {
+		p := zipenc.DefaultExtractPolicy
+		setExtractPolicy(*overwrite, p.Symlinks, p.MaxTotalSize, p.MaxEntries, p.MaxRatio)
+		err := zipenc.ExtractEntries(u, *target, *out, fs.Args())
+		u.Key.Wipe()
+		if err != nil {
+			log.Println(err)
+			os.Exit(-2)
+		}
+		return
+	}
+
+	a, err := zipenc.OpenArchive(u, *target)
+	u.Key.Wipe()
+	if err != nil {
+		log.Println(err)
+		os.Exit(-2)
+	}
+	defer a.Close()
+
+	switch args[0] {
+	case "list":
+		err = listEntries(a)
+	case "add":
+		for _, path := range fs.Args() {
+			if err = addEntry(a, path, *dir); err != nil {
+				break
+			}
+		}
+	case "remove":
+		for _, name := range fs.Args() {
+			if err = removeEntry(a, name); err != nil {
+				break
+			}
+		}
+	case "session":
+		err = archiveSession(a, *dir)
+		if errors.Is(err, errDiscarded) {
+			// a is closed and wiped by the deferred Close, nothing is saved
+			return
+		}
+	}
+	if err == nil {
+		err = a.Save()
+	}
+	if err != nil {
+		log.Println(err)
+		a.Close()
+		os.Exit(-2)
+	}
+}
+
+// print the entries of an archive
+func listEntries(a *zipenc.Archive) error {
+	entries, err := a.Entries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		fmt.Printf("%s %10d %s %s\n", e.Mode, e.Size, e.Modified.Format("2006-01-02 15:04"), e.Name)
+	}
+	return nil
+}
+
+// add a file or folder to an archive and report what it replaced
+func addEntry(a *zipenc.Archive, path string, dir string) error {
+	replaced, err := a.Add(path, dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range replaced {
+		fmt.Println("replaced", name)
+	}
+	fmt.Println("added", path)
+	return nil
+}
+
+// remove an entry (and everything below it) from an archive
+func removeEntry(a *zipenc.Archive, name string) error {
+	n, err := a.Remove(name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %s (%d entries)\n", name, n)
+	return nil
+}
+
+// the session ended with discard, the changes since the last save are dropped
+var errDiscarded = errors.New("archive session discarded")
+
+// edit an unlocked archive with commands read from stdin until quit
+// changes are kept in memory and written by save or quit, discard returns errDiscarded
+func archiveSession(a *zipenc.Archive, dir string) error {
+	help := "commands: list, add <path> [folder], remove <name>, save, quit (saves), discard (quits without saving)"
+	fmt.Println(help)
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var err error
+		switch {
+		case fields[0] == "list" && len(fields) == 1:
+			err = listEntries(a)
+		case fields[0] == "add" && len(fields) == 2:
+			err = addEntry(a, fields[1], dir)
+		case fields[0] == "add" && len(fields) == 3:
+			err = addEntry(a, fields[1], fields[2])
+		case fields[0] == "remove" && len(fields) == 2:
+			err = removeEntry(a, fields[1])
+		case fields[0] == "save" && len(fields) == 1:
+			err = a.Save()
+			if err == nil {
+				fmt.Println("saved")
+			}
+		case fields[0] == "quit" && len(fields) == 1:
+			return nil
+		case fields[0] == "discard" && len(fields) == 1:
+			return errDiscarded
+		default:
+			fmt.Println(help)
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+		}
+	}
+}
+
+// generate an X25519 identity file and print its public key
+// usage: captchazip keygen -out key.txt
+func keygenCommand(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "", "the identity file to create")
+	fs.Parse(args)
+	if *out == "" {
+		log.Fatal("-out is required")
+	}
+	priv, err := zipenc.GenerateIdentity()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = zipenc.WriteIdentityFile(*out, priv)
+	if err != nil {
+		log.Println(err)
+		os.Exit(-2)
+	}
+	fmt.Println("Public key:", zipenc.EncodeRecipient(priv.PublicKey()))
+}
+
+// manage a recipients file
+// usage: captchazip recipients list|add|remove -file recipients.txt [-key pub | -identity key.txt]
+func recipientsCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: captchazip recipients list|add|remove [flags]")
+	}
+	fs := flag.NewFlagSet("recipients "+args[0], flag.ExitOnError)
+	file := fs.String("file", "recipients.txt", "the recipients file")
+	key := fs.String("key", "", "the public key to add or remove")
+	identity := fs.String("identity", "", "add the public key of this identity file")
+	comment := fs.String("comment", "", "a comment written above an added key")
+	fs.Parse(args[1:])
+
+	if *identity != "" {
+		ids, err := zipenc.ReadIdentityFile(*identity)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*key = zipenc.EncodeRecipient(ids[0].PublicKey())
+	}
+
+	switch args[0] {
+	case "list":
+		recipients, err := zipenc.ReadRecipientsFile(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range recipients {
+			fmt.Println(zipenc.EncodeRecipient(r))
+		}
+	case "add":
+		if _, err := zipenc.ParseRecipient(*key); err != nil {
+			log.Fatal(err)
+		}
+		// the file is rewritten whole so a failed write leaves it as it was
+		content, err := os.ReadFile(*file)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		if len(content) > 0 && !strings.HasSuffix(string(content), "\n") {
+			content = append(content, '\n')
+		}
+		if *comment != "" {
+			content = append(content, "# "+*comment+"\n"...)
+		}
+		content = append(content, strings.TrimSpace(*key)+"\n"...)
+		if err := zipenc.WriteFileAtomic(*file, content, recipientsMode(*file)); err != nil {
+			log.Fatal(err)
+		}
+	case "remove":
+		content, err := os.ReadFile(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var kept []string
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			if strings.TrimSpace(line) != strings.TrimSpace(*key) {
+				kept = append(kept, line)
+			}
+		}
+		err = zipenc.WriteFileAtomic(*file, []byte(strings.Join(kept, "\n")+"\n"), recipientsMode(*file))
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown recipients command %q", args[0])
+	}
+}
+
+// the permissions of the recipients file, 0644 for a new one
+func recipientsMode(file string) os.FileMode {
+	if info, err := os.Stat(file); err == nil {
+		return info.Mode().Perm()
+	}
+	return 0644
+}
+
+// measure what one password guess costs an offline attacker
+// usage: captchazip analyze [-in file.bin | -hashes N -puzzles list]
+func analyzeCommand(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	target := fs.String("in", "", "an encrypted file whose key slots are analyzed")
+	N := fs.Int("hashes", 1000, "the number of hashes to analyze when no file is given")
+	puzzles := fs.String("puzzles", "", "comma separated puzzles to analyze when no file is given")
+	samples := fs.Int("samples", 3, "the number of runs each step is averaged over")
+	bits := fs.String("bits", "20,30,40,50,60,80", "comma separated password entropies (bits) to estimate brute force times for")
+	chessOptions := chessFlags(fs)
+	fs.Parse(args)
+	chessOpts := chessOptions()
+
+	var entropies []float64
+	for _, b := range strings.Split(*bits, ",") {
+		var v float64
+		if _, err := fmt.Sscan(strings.TrimSpace(b), &v); err != nil {
+			log.Fatalf("bad entropy %q", b)
+		}
+		entropies = append(entropies, v)
+	}
+
+	var configs []analyze.Config
+	var labels []string
+	if *target != "" {
+		slots, err := zipenc.ListSlots(*target)
+		if err != nil {
 			log.Println(err)
 			os.Exit(-2)
 		}
+		for i, s := range slots {
+			configs = append(configs, analyze.Config{N: s.N, Sudoku: s.SudokuPuzzle, Chess: s.Chess, HashPuzzle: s.HashPuzzle, ChessOptions: s.ChessSettings()})
+			labels = append(labels, fmt.Sprintf("slot %d (%s)", i, s.Label))
+		}
+	} else {
+		set := parsePuzzleSet(*puzzles)
+		configs = append(configs, analyze.Config{N: uint16(*N), Sudoku: set[0], Chess: set[1], HashPuzzle: set[2], ChessOptions: chessOpts})
+		labels = append(labels, "configuration")
 	}
 
+	cheapest := -1
+	var costs []analyze.Cost
+	for i, cfg := range configs {
+		fmt.Println(labels[i])
+		cost := analyze.Measure(cfg, *samples)
+		analyze.Report(os.Stdout, cfg, cost, entropies)
+		fmt.Println()
+		costs = append(costs, cost)
+		if cheapest < 0 || cost.PerGuess() < costs[cheapest].PerGuess() {
+			cheapest = i
+		}
+	}
+	if len(configs) > 1 {
+		fmt.Printf("an attacker targets the cheapest slot: %s at %v per guess\n", labels[cheapest], costs[cheapest].PerGuess())
+	}
+}
+
+// draw a chess position or a sudoku grid to an SVG or PNG image
+// usage: captchazip render (-fen FEN | -sudoku digits) -out image.svg|image.png
+func renderCommand(args []string) {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	fen := fs.String("fen", "", "the chess position to draw, in FEN")
+	grid := fs.String("sudoku", "", "the sudoku grid to draw, 81 digits row by row with 0 or . for an empty cell")
+	out := fs.String("out", "puzzle.png", "the image to write, .svg or .png")
+	themeName := fs.String("theme", render.DefaultTheme, "the colours: classic, green, blue or mono")
+	size := fs.Int("size", render.DefaultSize, "the side of the image in pixels")
+	coords := fs.Bool("coords", false, "draw the files and ranks around a chess board")
+	flip := fs.Bool("flip", false, "draw a chess board from black's side")
+	last := fs.String("last", "", "the move to mark on a chess board, in UCI (e.g. e2e4)")
+	noise := fs.Float64("noise", 0, "move and turn the pieces or digits and draw lines and dots over them, from 0 (none) to 1")
+	seed := fs.Int64("seed", 0, "draw the noise from this seed (0 for a random one)")
+	fs.Parse(args)
+
+	theme, ok := render.Themes[*themeName]
+	if !ok {
+		log.Fatalf("unknown theme %q", *themeName)
+	}
+	opt := render.Options{Theme: theme, Size: *size, Coordinates: *coords, Flip: *flip, LastMove: *last, Noise: *noise, Seed: *seed}
+	png := strings.EqualFold(filepath.Ext(*out), ".png")
+	if !png && !strings.EqualFold(filepath.Ext(*out), ".svg") {
+		log.Fatalf("%s is neither .svg nor .png", *out)
+	}
+
+	var img []byte
+	var err error
+	switch {
+	case *fen != "" && *grid == "":
+		if png {
+			img, err = render.ChessPNG(*fen, opt)
+		} else {
+			img, err = render.ChessSVG(*fen, opt)
+		}
+	case *grid != "" && *fen == "":
+		var g render.Grid
+		g, err = parseGrid(*grid)
+		if err != nil {
+			break
+		}
+		if png {
+			img, err = render.SudokuPNG(g, opt)
+		} else {
+			img, err = render.SudokuSVG(g, opt)
+		}
+	default:
+		log.Fatal("give either -fen or -sudoku")
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(-2)
+	}
+	if err := zipenc.WriteFileAtomic(*out, img, 0644); err != nil {
+		log.Println(err)
+		os.Exit(-2)
+	}
+}
+
+// read a sudoku grid of 81 digits, row by row, 0 or . for an empty cell
+func parseGrid(digits string) (render.Grid, error) {
+	var g render.Grid
+	digits = strings.Join(strings.Fields(digits), "")
+	if len(digits) != 81 {
+		return g, fmt.Errorf("a sudoku grid has 81 cells, %d given", len(digits))
+	}
+	for i, c := range digits {
+		switch {
+		case c == '.':
+		case c >= '0' && c <= '9':
+			g[i/9][i%9] = int(c - '0')
+		default:
+			return g, fmt.Errorf("cell %d is %q, not a digit", i+1, c)
+		}
+	}
+	return g, nil
 }